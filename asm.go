@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Textual form of a Program, the assembly language described in the Vm doc
+// comment. Every line contains a single instruction, an optional address, the
+// name of the operation and its argument, followed by an optional comment
+// starting with ';':
+//
+//	.var x                      ; declares the variable in the next slot
+//	.declare half               ; function in the next slot that is called but never defined
+//	.func double n              ; function in the next slot with parameter n
+//	0000  OP_LOAD_LOCAL 0       ; n
+//	0001  OP_MULTIPYI   2       ; n*2
+//	0002  OP_RETURN
+//	.end
+//	0000  OP_LOAD       21      ; 21
+//	0001  OP_PUSH
+//	0002  OP_LOAD       1
+//	0003  OP_CALL_FUNC  double  ; names are accepted in place of slots
+//	0004  OP_STORE_GLOBAL x
+//
+// Addresses are ignored by the assembler, names of operations are case
+// insensitive and the 'OP_' prefix is optional. OP_LOAD_GLOBAL and
+// OP_STORE_GLOBAL accept the name of a variable, OP_CALL the name of a
+// builtin and OP_CALL_FUNC the name of a function instead of a number.
+
+// operations without an argument
+var OP_NO_ARGUMENT = map[OpCode]bool{
+	OP_NOP:    true,
+	OP_NEG:    true,
+	OP_PUSH:   true,
+	OP_RETURN: true,
+	OP_RESULT: true,
+}
+
+// returned by the assembler for lines that are not valid assembly
+type AsmError struct {
+	Span Span   // location of the offending part of the line
+	Msg  string // description of the error
+	Hint string // may be empty
+}
+
+func (e *AsmError) Error() string {
+	return fmt.Sprintf("assembler: %s at %s", e.Msg, e.Span.Start)
+}
+
+func (e *AsmError) Diagnostic() *Diagnostic {
+	return &Diagnostic{Code: CODE_ASSEMBLY, Msg: e.Msg, Span: e.Span, Hint: e.Hint}
+}
+
+// writes p in its textual form to w. If src is the input p was compiled
+// from, each operation is commented with the source text of its span,
+// otherwise with the name of the symbol it references
+func Disassemble(w io.Writer, p *Program, src string) error {
+	b := strings.Builder{}
+	for _, name := range p.Globals {
+		fmt.Fprintf(&b, ".var %s\n", name)
+	}
+	for slot, f := range p.Functions {
+		if f == nil {
+			// keeps the slots of the following functions
+			fmt.Fprintf(&b, ".func _removed%d\n.end\n", slot)
+			continue
+		}
+		if f.declaration() {
+			fmt.Fprintf(&b, ".declare %s\n", f.Name)
+			continue
+		}
+		fmt.Fprintf(&b, ".func %s\n", strings.TrimSpace(f.Name+" "+strings.Join(f.Params, " ")))
+		disassembleChunk(&b, p, f.Code, f.Spans, src)
+		b.WriteString(".end\n")
+	}
+	disassembleChunk(&b, p, p.Code, p.Spans, src)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func disassembleChunk(b *strings.Builder, p *Program, code []Operation, spans []Span, src string) {
+	for i, op := range code {
+		name, ok := OP_LOOKUP[op.Code]
+		if !ok {
+			name = fmt.Sprintf("OP_UNKNOWN_%d", op.Code)
+		}
+		arg := ""
+		if !OP_NO_ARGUMENT[op.Code] {
+			arg = strconv.FormatFloat(op.Arg, 'g', -1, 64)
+		}
+		line := fmt.Sprintf("%04d  %-17s %-8s", i, name, arg)
+		comment := ""
+		if len(spans) == len(code) {
+			comment = excerpt(src, spans[i])
+		}
+		if comment == "" {
+			comment = p.symbol(op)
+		}
+		if comment != "" {
+			line += " ; " + comment
+		}
+		b.WriteString(strings.TrimRight(line, " "))
+		b.WriteRune('\n')
+	}
+}
+
+// source text of span on a single line, empty if span is not part of src
+func excerpt(src string, span Span) string {
+	if span.Start.Offset < 0 || span.End.Offset <= span.Start.Offset || span.End.Offset > len(src) {
+		return ""
+	}
+	text := strings.Join(strings.Fields(src[span.Start.Offset:span.End.Offset]), " ")
+	if runes := []rune(text); len(runes) > 40 {
+		text = string(runes[:37]) + "..."
+	}
+	return text
+}
+
+// name of the variable, builtin or function op references, empty if none
+func (p *Program) symbol(op Operation) string {
+	i := int(op.Arg)
+	switch op.Code {
+	case OP_LOAD_GLOBAL, OP_STORE_GLOBAL:
+		if i >= 0 && i < len(p.Globals) {
+			return p.Globals[i]
+		}
+	case OP_CALL:
+		if i >= 0 && i < len(BUILTINS) {
+			return BUILTINS[i].Name
+		}
+	case OP_CALL_FUNC:
+		if i >= 0 && i < len(p.Functions) && p.Functions[i] != nil {
+			return p.Functions[i].Name
+		}
+	}
+	return ""
+}
+
+// part of a line of assembly
+type field struct {
+	text string
+	span Span
+}
+
+// splits the line at whitespace, stops at the start of a comment
+func fields(line string, start Position) []field {
+	o := make([]field, 0)
+	pos := start
+	var cur *field
+	for _, r := range line {
+		if r == ';' {
+			break
+		}
+		next := Position{Offset: pos.Offset + len(string(r)), Line: pos.Line, Col: pos.Col + 1}
+		if r == ' ' || r == '\t' || r == '\r' {
+			cur = nil
+		} else if cur == nil {
+			o = append(o, field{text: string(r), span: Span{Start: pos, End: next}})
+			cur = &o[len(o)-1]
+		} else {
+			cur.text += string(r)
+			cur.span.End = next
+		}
+		pos = next
+	}
+	return o
+}
+
+// operation names in upper case without the 'OP_' prefix
+var opByName = func() map[string]OpCode {
+	m := make(map[string]OpCode, len(OP_LOOKUP))
+	for code, name := range OP_LOOKUP {
+		m[strings.TrimPrefix(name, "OP_")] = code
+	}
+	return m
+}()
+
+// parses the textual form of a program, see Disassemble. Returns an
+// ErrorList of *AsmError for all invalid lines
+func Assemble(src string) (*Program, error) {
+	p := &Program{
+		Code:      make([]Operation, 0),
+		Spans:     make([]Span, 0),
+		Globals:   make([]string, 0),
+		Functions: make([]*Function, 0),
+	}
+	errs := ErrorList{}
+	fail := func(span Span, hint string, format string, a ...any) {
+		errs = append(errs, &AsmError{Span: span, Msg: fmt.Sprintf(format, a...), Hint: hint})
+	}
+
+	lines := make([][]field, 0)
+	offset := 0
+	for i, line := range strings.Split(src, "\n") {
+		lines = append(lines, fields(line, Position{Offset: offset, Line: i + 1, Col: 1}))
+		offset += len(line) + 1
+	}
+
+	// functions can be called before they are defined
+	funcs := make(map[string]int)
+	for _, line := range lines {
+		if len(line) > 1 && (line[0].text == ".func" || line[0].text == ".declare") {
+			if _, ok := funcs[line[1].text]; !ok {
+				funcs[line[1].text] = len(funcs)
+			}
+		}
+	}
+	globals := make(map[string]int)
+
+	var fn *Function
+	var fnStart Span
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		switch line[0].text {
+		case ".var":
+			if len(line) != 2 {
+				fail(line[0].span, "", "expected '.var <name>'")
+				continue
+			}
+			name := line[1]
+			if _, ok := globals[name.text]; ok {
+				fail(name.span, "", "variable %q is already declared", name.text)
+				continue
+			}
+			if _, ok := CONSTANTS[name.text]; ok {
+				fail(name.span, "", "can not declare constant %q as a variable", name.text)
+				continue
+			}
+			globals[name.text] = len(p.Globals)
+			p.Globals = append(p.Globals, name.text)
+			continue
+		case ".declare":
+			if fn != nil {
+				fail(line[0].span, "end the function with '.end' first", "declaration inside of a function")
+				continue
+			}
+			if len(line) != 2 {
+				fail(line[0].span, "", "expected '.declare <name>'")
+				continue
+			}
+			name := line[1]
+			if _, ok := lookupBuiltin(name.text); ok {
+				fail(name.span, "", "can not redefine builtin %q", name.text)
+			} else if funcs[name.text] != len(p.Functions) {
+				fail(name.span, "", "function %q is already defined", name.text)
+			}
+			p.Functions = append(p.Functions, &Function{Name: name.text})
+			continue
+		case ".func":
+			if fn != nil {
+				fail(line[0].span, "end the function with '.end' first", "nested function")
+				continue
+			}
+			if len(line) < 2 {
+				fail(line[0].span, "", "expected '.func <name> <parameters>'")
+				continue
+			}
+			fnStart = line[0].span
+			fn = &Function{Name: line[1].text, Params: make([]string, 0), Code: make([]Operation, 0), Spans: make([]Span, 0)}
+			if _, ok := lookupBuiltin(fn.Name); ok {
+				fail(line[1].span, "", "can not redefine builtin %q", fn.Name)
+			} else if funcs[fn.Name] != len(p.Functions) {
+				fail(line[1].span, "", "function %q is already defined", fn.Name)
+			}
+			for _, param := range line[2:] {
+				fn.Params = append(fn.Params, param.text)
+			}
+			continue
+		case ".end":
+			if fn == nil {
+				fail(line[0].span, "", "'.end' outside of a function")
+				continue
+			}
+			p.Functions = append(p.Functions, fn)
+			fn = nil
+			continue
+		}
+
+		// optional address
+		if _, err := strconv.Atoi(line[0].text); err == nil {
+			line = line[1:]
+			if len(line) == 0 {
+				continue
+			}
+		}
+		mnemonic := line[0]
+		code, ok := opByName[strings.TrimPrefix(strings.ToUpper(mnemonic.text), "OP_")]
+		if !ok {
+			fail(mnemonic.span, "operations are named like in the Vm documentation, e.g. 'OP_LOAD'", "unknown operation %q", mnemonic.text)
+			continue
+		}
+		span := Span{Start: mnemonic.span.Start, End: line[len(line)-1].span.End}
+		op := Operation{Code: code}
+		switch {
+		case OP_NO_ARGUMENT[code] && len(line) > 1:
+			fail(line[1].span, "", "%s takes no argument", OP_LOOKUP[code])
+			continue
+		case !OP_NO_ARGUMENT[code] && len(line) != 2:
+			fail(span, "", "%s takes exactly one argument", OP_LOOKUP[code])
+			continue
+		case len(line) == 2:
+			arg, err := argument(code, line[1].text, globals, funcs)
+			if err != nil {
+				fail(line[1].span, "", "%s", err)
+				continue
+			}
+			op.Arg = arg
+		}
+		if fn != nil {
+			fn.Code = append(fn.Code, op)
+			fn.Spans = append(fn.Spans, span)
+		} else {
+			p.Code = append(p.Code, op)
+			p.Spans = append(p.Spans, span)
+		}
+	}
+	if fn != nil {
+		fail(fnStart, "add '.end' after the last operation of the function", "function %s is not closed", fn.Name)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return p, nil
+}
+
+// parses the argument of an operation, a number or the name of a symbol
+func argument(code OpCode, text string, globals map[string]int, funcs map[string]int) (float64, error) {
+	if val, err := strconv.ParseFloat(text, 64); err == nil {
+		return val, nil
+	}
+	switch code {
+	case OP_LOAD_GLOBAL, OP_STORE_GLOBAL:
+		if slot, ok := globals[text]; ok {
+			return float64(slot), nil
+		}
+		return 0, fmt.Errorf("undeclared variable %q, declare it with '.var %s'", text, text)
+	case OP_CALL:
+		if i, ok := lookupBuiltin(text); ok {
+			return float64(i), nil
+		}
+		return 0, fmt.Errorf("unknown builtin %q", text)
+	case OP_CALL_FUNC:
+		if slot, ok := funcs[text]; ok {
+			return float64(slot), nil
+		}
+		return 0, fmt.Errorf("unknown function %q", text)
+	}
+	return 0, fmt.Errorf("invalid argument %q, expected a number", text)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// compiles in with the peephole optimizer to a program
+func compileProgram(t *testing.T, in string) *Program {
+	t.Helper()
+	env := NewEnv()
+	compiler := NewCompiler(env)
+	compiler.Peephole = true
+	code, err := compiler.Compile(parse(t, in))
+	assert.NoError(t, err)
+	return NewProgram(env, code, compiler.Spans)
+}
+
+// like assert.Equal, but NaN arguments equal NaN
+func sameOperations(a, b []Operation) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Code != b[i].Code || !sameFloat(a[i].Arg, b[i].Arg) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDisassemble(t *testing.T) {
+	in := "x = 3\nf(a) = a * 2\nf(x) - max(x, 1)"
+	b := strings.Builder{}
+	assert.NoError(t, Disassemble(&b, compileProgram(t, in), in))
+	assert.Equal(t, `.var x
+.func f a
+0000  OP_LOAD_LOCAL     0        ; a
+0001  OP_MULTIPYI       2        ; a * 2
+0002  OP_RETURN                  ; f(a) = a * 2
+.end
+0000  OP_LOAD           3        ; 3
+0001  OP_STORE_GLOBAL   0        ; x = 3
+0002  OP_RESULT                  ; x = 3
+0003  OP_PUSH                    ; f(x)
+0004  OP_LOAD           1        ; f(x)
+0005  OP_CALL_FUNC      0        ; f(x)
+0006  OP_STORE          1        ; f(x) - max(x, 1)
+0007  OP_LOAD_GLOBAL    0        ; x
+0008  OP_PUSH                    ; max(x, 1)
+0009  OP_LOAD           1        ; 1
+0010  OP_PUSH                    ; max(x, 1)
+0011  OP_LOAD           2        ; max(x, 1)
+0012  OP_CALL           23       ; max(x, 1)
+0013  OP_SUBTRACT       1        ; f(x) - max(x, 1)
+0014  OP_RESULT                  ; f(x) - max(x, 1)
+`, b.String())
+
+	// without the source the referenced symbols are named
+	b.Reset()
+	assert.NoError(t, Disassemble(&b, compileProgram(t, in), ""))
+	assert.Contains(t, b.String(), "0005  OP_CALL_FUNC      0        ; f\n")
+	assert.Contains(t, b.String(), "0007  OP_LOAD_GLOBAL    0        ; x\n")
+	assert.Contains(t, b.String(), "0012  OP_CALL           23       ; max\n")
+	assert.Contains(t, b.String(), "0001  OP_MULTIPYI       2\n")
+}
+
+func TestAssembleRoundTrip(t *testing.T) {
+	tests := []string{
+		"1+2*3",
+		"x = 2\ny = x ^ 0.5 // 3 % -1e3",
+		"f(a, b) = a*2 - b\ng() = f(1, 2) / 0\nf(g(), 3) + hypot(3, 4)",
+		"n = nan\nm = inf\ny = -n * m",
+		balanced("-", "2", SPILL_REGISTER),
+	}
+	for _, in := range tests {
+		t.Run(in, func(t *testing.T) {
+			p := compileProgram(t, in)
+			b := strings.Builder{}
+			assert.NoError(t, Disassemble(&b, p, in))
+			assembled, err := Assemble(b.String())
+			assert.NoError(t, err)
+
+			assert.True(t, sameOperations(p.Code, assembled.Code), "expected %v, got %v", p.Code, assembled.Code)
+			assert.Equal(t, p.Globals, assembled.Globals)
+			assert.Len(t, assembled.Functions, len(p.Functions))
+			for i, f := range p.Functions {
+				assert.Equal(t, f.Name, assembled.Functions[i].Name)
+				assert.Equal(t, f.Params, assembled.Functions[i].Params)
+				assert.True(t, sameOperations(f.Code, assembled.Functions[i].Code))
+			}
+
+			results := make([]float64, 0, 2)
+			for _, program := range []*Program{p, assembled} {
+				vm := Vm{env: NewEnv()}
+				assert.NoError(t, program.Load(vm.env))
+				assert.NoError(t, vm.NewVmIn(program.Code).Execute())
+				results = append(results, vm.reg[0])
+			}
+			assert.True(t, sameFloat(results[0], results[1]), "expected %v, got %v", results[0], results[1])
+		})
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	src := `; doubles 21, stores it in x and computes its square root
+.var x
+0000 load 21   ; addresses are ignored
+     OP_PUSH
+7    op_load 1
+     OP_CALL_FUNC double   ; called before it is defined
+     OP_STORE_GLOBAL x
+     OP_PUSH
+     OP_LOAD 1
+     OP_CALL sqrt
+
+.func double n
+     OP_LOAD_LOCAL 0
+     OP_MULTIPYI 2
+     OP_RETURN
+.end
+`
+	p, err := Assemble(src)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, p.Globals)
+	assert.Equal(t, []Operation{
+		{OP_LOAD, 21},
+		{OP_PUSH, 0},
+		{OP_LOAD, 1},
+		{OP_CALL_FUNC, 0},
+		{OP_STORE_GLOBAL, 0},
+		{OP_PUSH, 0},
+		{OP_LOAD, 1},
+		{OP_CALL, 1},
+	}, p.Code)
+	assert.Equal(t, span(3, 6, 70, 77), p.Spans[0])
+	assert.Equal(t, "double", p.Functions[0].Name)
+	assert.Equal(t, []string{"n"}, p.Functions[0].Params)
+	assert.Equal(t, []Operation{{OP_LOAD_LOCAL, 0}, {OP_MULTIPYI, 2}, {OP_RETURN, 0}}, p.Functions[0].Code)
+
+	vm := Vm{env: NewEnv()}
+	assert.NoError(t, p.Load(vm.env))
+	assert.NoError(t, vm.NewVmIn(p.Code).Execute())
+	assert.Equal(t, math.Sqrt(42), vm.reg[0])
+	x, ok := vm.env.Get("x")
+	assert.True(t, ok)
+	assert.Equal(t, float64(42), x)
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		msgs []string
+	}{
+		{name: "unknown operation", in: "OP_JUMP 1", msgs: []string{`unknown operation "OP_JUMP"`}},
+		{name: "missing argument", in: "OP_LOAD", msgs: []string{"OP_LOAD takes exactly one argument"}},
+		{name: "unexpected argument", in: "OP_NEG 1", msgs: []string{"OP_NEG takes no argument"}},
+		{name: "invalid argument", in: "OP_LOAD one", msgs: []string{`invalid argument "one", expected a number`}},
+		{name: "undeclared variable", in: "OP_LOAD_GLOBAL x", msgs: []string{`undeclared variable "x", declare it with '.var x'`}},
+		{name: "unknown builtin", in: "OP_CALL foo", msgs: []string{`unknown builtin "foo"`}},
+		{name: "unknown function", in: "OP_CALL_FUNC foo", msgs: []string{`unknown function "foo"`}},
+		{name: "duplicate variable", in: ".var x\n.var x", msgs: []string{`variable "x" is already declared`}},
+		{name: "constant variable", in: ".var pi", msgs: []string{`can not declare constant "pi" as a variable`}},
+		{name: "unclosed function", in: ".func f\nOP_RETURN", msgs: []string{"function f is not closed"}},
+		{name: "nested function", in: ".func f\n.func g\n.end", msgs: []string{"nested function"}},
+		{name: "end outside function", in: ".end", msgs: []string{"'.end' outside of a function"}},
+		{name: "redefined builtin", in: ".func sqrt x\n.end", msgs: []string{`can not redefine builtin "sqrt"`}},
+		{name: "duplicate function", in: ".func f\n.end\n.func f\n.end", msgs: []string{`function "f" is already defined`}},
+		{name: "multiple errors", in: "OP_FOO\nOP_LOAD 1\nOP_BAR", msgs: []string{`unknown operation "OP_FOO"`, `unknown operation "OP_BAR"`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Assemble(test.in)
+			var list ErrorList
+			assert.ErrorAs(t, err, &list)
+			assert.Len(t, list, len(test.msgs))
+			for i, msg := range test.msgs {
+				var asmErr *AsmError
+				if assert.True(t, errors.As(list[i], &asmErr)) {
+					assert.Equal(t, msg, asmErr.Msg)
+				}
+			}
+		})
+	}
+}
+
+func TestProgramLoad(t *testing.T) {
+	p := compileProgram(t, "x = 1\ny = 2\nf(a) = a\nf(x + y)")
+
+	env := NewEnv()
+	assert.NoError(t, env.Set("y", 5))
+	assert.Error(t, p.Load(env))
+
+	env = NewEnv()
+	assert.NoError(t, env.DefineConst("x", 5))
+	assert.Error(t, p.Load(env))
+
+	vm := Vm{env: NewEnv()}
+	assert.NoError(t, p.Load(vm.env))
+	assert.NoError(t, vm.NewVmIn(p.Code).Execute())
+	assert.Equal(t, float64(3), vm.reg[0])
+}
+
+func TestProgramDeclaredFunction(t *testing.T) {
+	in := "f(x) = g(x) + 1"
+	p := compileProgram(t, in)
+	if assert.Len(t, p.Functions, 2) {
+		// declared by the call while compiling the body of f
+		assert.True(t, p.Functions[0].declaration())
+		assert.Equal(t, "g", p.Functions[0].Name)
+	}
+
+	b := strings.Builder{}
+	assert.NoError(t, Disassemble(&b, p, ""))
+	assert.Contains(t, b.String(), ".declare g\n")
+	assert.Contains(t, b.String(), "OP_CALL_FUNC      0        ; g\n")
+	assembled, err := Assemble(b.String())
+	assert.NoError(t, err)
+	assert.Equal(t, p.Functions[0], assembled.Functions[0])
+	assert.NoError(t, Verify(assembled))
+
+	// defining the function in the loaded env fills the declared slot
+	env := NewEnv()
+	assert.NoError(t, p.Load(env))
+	code, err := Compile(env, parse(t, "g(x) = x * 2\nf(3)"))
+	assert.NoError(t, err)
+	vm := Vm{env: env}
+	assert.NoError(t, vm.NewVmIn(code).Execute())
+	assert.Equal(t, []float64{7}, vm.Results())
+}
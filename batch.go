@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// evaluates every line read from r on its own, definitions and variables of
+// earlier lines are visible to later ones. The results of each line are
+// written to out, prefixed with the number of the line. Errors are rendered
+// to errOut and do not stop the evaluation of the following lines. Returns
+// the amount of lines that failed
+func EvalLines(r io.Reader, out, errOut io.Writer, eval func(ast []Node) ([]float64, error)) (int, error) {
+	failed := 0
+	scanner := bufio.NewScanner(r)
+	start := Position{Offset: 0, Line: 0, Col: 1}
+	for scanner.Scan() {
+		line := scanner.Text()
+		start.Line++
+		results, err := evalLine(line, start, eval)
+		start.Offset += len(line) + 1
+		if err != nil {
+			failed++
+			renderError(errOut, []string{line}, start.Line, err)
+			continue
+		}
+		for _, result := range results {
+			fmt.Fprintf(out, "%4d: %v\n", start.Line, result)
+		}
+	}
+	return failed, scanner.Err()
+}
+
+func evalLine(line string, start Position, eval func(ast []Node) ([]float64, error)) ([]float64, error) {
+	token, err := NewLexerAt(strings.NewReader(line), start).Lex()
+	if err != nil {
+		return nil, err
+	}
+	ast, err := NewParser(token).Parse()
+	if err != nil {
+		return nil, err
+	}
+	return eval(ast)
+}
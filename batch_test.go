@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvalLines(t *testing.T) {
+	in := strings.Join([]string{
+		"# definitions",
+		"f(x) = x * 2",
+		"y = f(2)",
+		"",
+		"y + 1 )",
+		"f(y) f(1)",
+		"z",
+		"1/4",
+	}, "\n")
+
+	backends := map[string]func(env *Env) func([]Node) ([]float64, error){
+		"vm": func(env *Env) func([]Node) ([]float64, error) {
+			return func(ast []Node) ([]float64, error) {
+				code, err := Compile(env, ast)
+				if err != nil {
+					return nil, err
+				}
+				vm := Vm{env: env}
+				err = vm.NewVmIn(code).Execute()
+				return vm.Results(), err
+			}
+		},
+		"tree": func(env *Env) func([]Node) ([]float64, error) {
+			return func(ast []Node) ([]float64, error) {
+				return EvalResults(env, ast)
+			}
+		},
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			out, errOut := &strings.Builder{}, &strings.Builder{}
+			failed, err := EvalLines(strings.NewReader(in), out, errOut, backend(NewEnv()))
+			assert.NoError(t, err)
+			assert.Equal(t, 2, failed)
+			assert.Equal(t, "   3: 4\n   6: 8\n   6: 2\n   8: 0.25\n", out.String())
+			assert.Contains(t, errOut.String(), "error[E005]: unmatched ')'\n --> 5:7\n")
+			assert.Contains(t, errOut.String(), "5 | y + 1 )\n")
+			assert.Contains(t, errOut.String(), "error[E010]: undefined variable \"z\"\n --> 7:1\n")
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Binary format of a Program, the content of .calcb files. All integers are
+// little endian, numbers without a fixed size are unsigned varints
+// (encoding/binary.PutUvarint), strings are their length followed by their
+// bytes:
+//
+//	magic     "CALC"
+//	version   uint16, BINARY_VERSION
+//	flags     uint16, BINARY_FLAG_DEBUG if the debug section is present
+//	constants varint count, followed by the bits of each float64 as uint64
+//	globals   varint count, followed by the name of each variable
+//	functions varint count, followed by a byte that is 0 for removed functions,
+//	          2 and the name for declared functions, otherwise 1 and the
+//	          name, varint count of parameters, the name of each parameter
+//	          and the chunk of the function
+//	code      chunk of the program
+//	debug     only if BINARY_FLAG_DEBUG is set: the source, the spans of the
+//	          code followed by the spans of each defined function
+//
+// A chunk is the varint count of operations, followed by the opcode of each
+// operation as a single byte and, if the operation takes an argument, the
+// varint index of the argument into the constants. Spans are the varint
+// count of spans followed by offset, line and column of start and end of
+// each span as varints.
+
+// identifies calc bytecode files
+const BINARY_MAGIC = "CALC"
+
+// version of the binary format, files of other versions are rejected
+const BINARY_VERSION uint16 = 3
+
+// set in the flags if the file contains a debug section
+const BINARY_FLAG_DEBUG uint16 = 1
+
+// returned by UnmarshalBinary for data that is not a valid program
+var ErrInvalidBinary = errors.New("invalid bytecode")
+
+// encodes the program in the binary format, includes the debug section if
+// the program has spans and the source they point into
+func (p *Program) MarshalBinary() ([]byte, error) {
+	e := &encoder{constants: make(map[uint64]int)}
+	chunks := [][]Operation{p.Code}
+	for _, f := range p.Functions {
+		if f != nil {
+			chunks = append(chunks, f.Code)
+		}
+	}
+	for _, chunk := range chunks {
+		for _, op := range chunk {
+			if _, ok := OP_LOOKUP[op.Code]; !ok {
+				return nil, fmt.Errorf("unknown opcode %d", op.Code)
+			}
+			if OP_NO_ARGUMENT[op.Code] {
+				if op.Arg != 0 {
+					return nil, fmt.Errorf("%s takes no argument, got %v", OP_LOOKUP[op.Code], op.Arg)
+				}
+				continue
+			}
+			e.constant(op.Arg)
+		}
+	}
+
+	debug := len(p.Spans) == len(p.Code) && len(p.Spans) > 0 && p.Source != ""
+	flags := uint16(0)
+	if debug {
+		flags |= BINARY_FLAG_DEBUG
+	}
+	e.buf.WriteString(BINARY_MAGIC)
+	binary.Write(&e.buf, binary.LittleEndian, BINARY_VERSION)
+	binary.Write(&e.buf, binary.LittleEndian, flags)
+
+	e.uvarint(len(e.pool))
+	for _, bits := range e.pool {
+		binary.Write(&e.buf, binary.LittleEndian, bits)
+	}
+	e.uvarint(len(p.Globals))
+	for _, name := range p.Globals {
+		e.string(name)
+	}
+	e.uvarint(len(p.Functions))
+	for _, f := range p.Functions {
+		if f == nil {
+			e.buf.WriteByte(0)
+			continue
+		}
+		if f.declaration() {
+			e.buf.WriteByte(2)
+			e.string(f.Name)
+			continue
+		}
+		e.buf.WriteByte(1)
+		e.string(f.Name)
+		e.uvarint(len(f.Params))
+		for _, param := range f.Params {
+			e.string(param)
+		}
+		e.chunk(f.Code)
+	}
+	e.chunk(p.Code)
+
+	if debug {
+		e.string(p.Source)
+		e.spans(p.Spans)
+		for _, f := range p.Functions {
+			if f == nil || f.declaration() {
+				continue
+			}
+			if len(f.Spans) == len(f.Code) {
+				e.spans(f.Spans)
+			} else {
+				e.spans(nil)
+			}
+		}
+	}
+	return e.buf.Bytes(), nil
+}
+
+type encoder struct {
+	buf       bytes.Buffer
+	pool      []uint64       // bits of the constants in order of first use
+	constants map[uint64]int // bits of a constant to its index in pool
+}
+
+// adds the value to the constant pool, returns its index
+func (e *encoder) constant(v float64) int {
+	bits := math.Float64bits(v)
+	if i, ok := e.constants[bits]; ok {
+		return i
+	}
+	e.pool = append(e.pool, bits)
+	e.constants[bits] = len(e.pool) - 1
+	return len(e.pool) - 1
+}
+
+func (e *encoder) uvarint(v int) {
+	e.buf.Write(binary.AppendUvarint(nil, uint64(v)))
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(len(s))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) chunk(code []Operation) {
+	e.uvarint(len(code))
+	for _, op := range code {
+		e.buf.WriteByte(byte(op.Code))
+		if !OP_NO_ARGUMENT[op.Code] {
+			e.uvarint(e.constant(op.Arg))
+		}
+	}
+}
+
+func (e *encoder) spans(spans []Span) {
+	e.uvarint(len(spans))
+	for _, s := range spans {
+		for _, pos := range []Position{s.Start, s.End} {
+			e.uvarint(pos.Offset)
+			e.uvarint(pos.Line)
+			e.uvarint(pos.Col)
+		}
+	}
+}
+
+// decodes a program in the binary format, returns an error wrapping
+// ErrInvalidBinary if data is not a valid program
+func (p *Program) UnmarshalBinary(data []byte) error {
+	d := &decoder{r: bytes.NewReader(data)}
+	magic := make([]byte, len(BINARY_MAGIC))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != BINARY_MAGIC {
+		return fmt.Errorf("%w: missing %q header", ErrInvalidBinary, BINARY_MAGIC)
+	}
+	var version, flags uint16
+	if err := binary.Read(d.r, binary.LittleEndian, &version); err != nil {
+		return d.fail("version", err)
+	}
+	if version != BINARY_VERSION {
+		return fmt.Errorf("%w: unsupported version %d, expected %d", ErrInvalidBinary, version, BINARY_VERSION)
+	}
+	if err := binary.Read(d.r, binary.LittleEndian, &flags); err != nil {
+		return d.fail("flags", err)
+	}
+
+	count, err := d.count("constants")
+	if err != nil {
+		return err
+	}
+	d.constants = make([]float64, count)
+	for i := range d.constants {
+		var bits uint64
+		if err := binary.Read(d.r, binary.LittleEndian, &bits); err != nil {
+			return d.fail("constants", err)
+		}
+		d.constants[i] = math.Float64frombits(bits)
+	}
+
+	count, err = d.count("globals")
+	if err != nil {
+		return err
+	}
+	globals := make([]string, count)
+	for i := range globals {
+		if globals[i], err = d.string("globals"); err != nil {
+			return err
+		}
+	}
+
+	count, err = d.count("functions")
+	if err != nil {
+		return err
+	}
+	functions := make([]*Function, count)
+	for i := range functions {
+		present, err := d.r.ReadByte()
+		if err != nil {
+			return d.fail("functions", err)
+		}
+		if present == 0 {
+			continue
+		}
+		if present > 2 {
+			return fmt.Errorf("%w: function %d is neither removed, declared nor defined", ErrInvalidBinary, i)
+		}
+		f := &Function{}
+		if f.Name, err = d.string("function name"); err != nil {
+			return err
+		}
+		if present == 2 {
+			functions[i] = f
+			continue
+		}
+		params, err := d.count("parameters")
+		if err != nil {
+			return err
+		}
+		f.Params = make([]string, params)
+		for j := range f.Params {
+			if f.Params[j], err = d.string("parameters"); err != nil {
+				return err
+			}
+		}
+		if f.Code, err = d.chunk(); err != nil {
+			return err
+		}
+		functions[i] = f
+	}
+	code, err := d.chunk()
+	if err != nil {
+		return err
+	}
+
+	var source string
+	var spans []Span
+	if flags&BINARY_FLAG_DEBUG != 0 {
+		if source, err = d.string("source"); err != nil {
+			return err
+		}
+		if spans, err = d.spans(source); err != nil {
+			return err
+		}
+		for _, f := range functions {
+			if f == nil || f.declaration() {
+				continue
+			}
+			if f.Spans, err = d.spans(source); err != nil {
+				return err
+			}
+		}
+	}
+	if d.r.Len() > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidBinary, d.r.Len())
+	}
+
+	*p = Program{Code: code, Spans: spans, Globals: globals, Functions: functions, Source: source}
+	return nil
+}
+
+type decoder struct {
+	r         *bytes.Reader
+	constants []float64
+}
+
+func (d *decoder) fail(section string, err error) error {
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: reading %s: %s", ErrInvalidBinary, section, err)
+}
+
+// reads a count of elements, rejects counts exceeding the remaining data,
+// every element takes at least one byte
+func (d *decoder) count(section string) (int, error) {
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, d.fail(section, err)
+	}
+	if v > uint64(d.r.Len()) {
+		return 0, d.fail(section, fmt.Errorf("count %d exceeds the remaining %d bytes", v, d.r.Len()))
+	}
+	return int(v), nil
+}
+
+func (d *decoder) string(section string) (string, error) {
+	n, err := d.count(section)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return "", d.fail(section, err)
+	}
+	return string(b), nil
+}
+
+func (d *decoder) chunk() ([]Operation, error) {
+	n, err := d.count("code")
+	if err != nil {
+		return nil, err
+	}
+	code := make([]Operation, n)
+	for i := range code {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return nil, d.fail("code", err)
+		}
+		op := Operation{Code: OpCode(b)}
+		if _, ok := OP_LOOKUP[op.Code]; !ok {
+			return nil, fmt.Errorf("%w: unknown opcode %d at %d", ErrInvalidBinary, b, i)
+		}
+		if !OP_NO_ARGUMENT[op.Code] {
+			index, err := binary.ReadUvarint(d.r)
+			if err != nil {
+				return nil, d.fail("code", err)
+			}
+			if index >= uint64(len(d.constants)) {
+				return nil, fmt.Errorf("%w: constant %d of operation %d out of bounds", ErrInvalidBinary, index, i)
+			}
+			op.Arg = d.constants[index]
+		}
+		code[i] = op
+	}
+	return code, nil
+}
+
+// reads spans, rejects spans that are not part of source: positions start at
+// line and column 1, offsets are inside of source and a span does not end
+// before it starts
+func (d *decoder) spans(source string) ([]Span, error) {
+	n, err := d.count("debug")
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	spans := make([]Span, n)
+	for i := range spans {
+		var v [6]int
+		for j := range v {
+			u, err := binary.ReadUvarint(d.r)
+			if err != nil {
+				return nil, d.fail("debug", err)
+			}
+			// neither a line nor a column can exceed the length of the source
+			if u > uint64(len(source))+1 {
+				return nil, fmt.Errorf("%w: span %d out of bounds of the source", ErrInvalidBinary, i)
+			}
+			v[j] = int(u)
+		}
+		span := Span{
+			Start: Position{Offset: v[0], Line: v[1], Col: v[2]},
+			End:   Position{Offset: v[3], Line: v[4], Col: v[5]},
+		}
+		if err := checkSpan(span, len(source)); err != nil {
+			return nil, fmt.Errorf("%w: span %d %s", ErrInvalidBinary, i, err)
+		}
+		spans[i] = span
+	}
+	return spans, nil
+}
+
+// errors if span is not a valid span of a source of length n
+func checkSpan(span Span, n int) error {
+	switch {
+	case span.Start.Line < 1 || span.Start.Col < 1 || span.End.Line < 1 || span.End.Col < 1:
+		return errors.New("has a line or column below 1")
+	case span.Start.Offset > n || span.End.Offset > n:
+		return fmt.Errorf("has an offset outside of the source of %d bytes", n)
+	case span.End.Offset < span.Start.Offset || span.End.Line < span.Start.Line ||
+		(span.End.Line == span.Start.Line && span.End.Col < span.Start.Col):
+		return errors.New("ends before it starts")
+	}
+	return nil
+}
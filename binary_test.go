@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		exp  float64
+	}{
+		{name: "number", in: "1+2", exp: 3},
+		{name: "variables", in: "x = 3\ny = x - 1\nx * y", exp: 6},
+		{name: "functions", in: "f(a, b) = a^b\ng(x) = f(x, 2) + 1\ng(3)", exp: 10},
+		{name: "builtins", in: "max(1, sqrt(16), 2) + pi", exp: 4 + math.Pi},
+		{name: "special values", in: "x = nan\ny = -inf\n0", exp: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := compileProgram(t, test.in)
+			p.Source = test.in
+			data, err := p.MarshalBinary()
+			assert.NoError(t, err)
+
+			decoded := &Program{}
+			assert.NoError(t, decoded.UnmarshalBinary(data))
+			assert.True(t, sameOperations(p.Code, decoded.Code))
+			assert.Equal(t, p.Spans, decoded.Spans)
+			assert.Equal(t, p.Globals, decoded.Globals)
+			assert.Equal(t, p.Source, decoded.Source)
+			assert.Len(t, decoded.Functions, len(p.Functions))
+			for i, f := range p.Functions {
+				assert.Equal(t, f.Name, decoded.Functions[i].Name)
+				assert.Equal(t, f.Params, decoded.Functions[i].Params)
+				assert.Equal(t, f.Code, decoded.Functions[i].Code)
+				assert.Equal(t, f.Spans, decoded.Functions[i].Spans)
+			}
+
+			vm := Vm{env: NewEnv()}
+			assert.NoError(t, decoded.Load(vm.env))
+			assert.NoError(t, vm.NewVmIn(decoded.Code).Execute())
+			assert.Equal(t, test.exp, vm.reg[0])
+		})
+	}
+}
+
+func TestBinaryWithoutDebug(t *testing.T) {
+	p := compileProgram(t, "f(x) = x * 2\nf(21)")
+	p.Source = "f(x) = x * 2\nf(21)"
+	withDebug, err := p.MarshalBinary()
+	assert.NoError(t, err)
+
+	p.Spans = nil
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Less(t, len(data), len(withDebug))
+
+	decoded := &Program{}
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Nil(t, decoded.Spans)
+	assert.Nil(t, decoded.Functions[0].Spans)
+	assert.Equal(t, p.Code, decoded.Code)
+}
+
+func TestBinaryRemovedFunction(t *testing.T) {
+	p := &Program{
+		Code:      []Operation{{OP_LOAD, 1}, {OP_PUSH, 0}, {OP_LOAD, 1}, {OP_CALL_FUNC, 1}},
+		Functions: []*Function{nil, {Name: "f", Params: []string{"x"}, Code: []Operation{{OP_LOAD_LOCAL, 0}, {OP_RETURN, 0}}}},
+	}
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := &Program{}
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Nil(t, decoded.Functions[0])
+	assert.Equal(t, "f", decoded.Functions[1].Name)
+}
+
+func TestBinaryDeclaredFunction(t *testing.T) {
+	in := "f(x) = g(x) + 1\nf(1)"
+	p := compileProgram(t, in)
+	p.Source = in
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := &Program{}
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, &Function{Name: "g"}, decoded.Functions[0])
+	assert.NoError(t, Verify(decoded))
+
+	vm := Vm{env: NewEnv()}
+	assert.NoError(t, decoded.Load(vm.env))
+	var runtimeErr *RuntimeError
+	if assert.ErrorAs(t, vm.NewVmIn(decoded.Code).Execute(), &runtimeErr) {
+		assert.Equal(t, `unknown function "g"`, runtimeErr.Msg)
+	}
+}
+
+func TestMarshalBinaryErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		code []Operation
+	}{
+		{name: "unknown opcode", code: []Operation{{OpCode(255), 0}}},
+		{name: "argument of operation without argument", code: []Operation{{OP_NEG, 1}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := (&Program{Code: test.code}).MarshalBinary()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	p := compileProgram(t, "f(x) = x * 2\ny = f(21)")
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "wrong magic", data: append([]byte("CALX"), data[4:]...)},
+		{name: "unsupported version", data: append(append([]byte{}, data[:4]...), append([]byte{byte(BINARY_VERSION + 1), 0}, data[6:]...)...)},
+		{name: "trailing bytes", data: append(append([]byte{}, data...), 0)},
+		{name: "huge count", data: append(append([]byte{}, data[:8]...), 0xff, 0xff, 0xff, 0xff, 0x0f)},
+		{name: "unknown opcode", data: []byte{'C', 'A', 'L', 'C', byte(BINARY_VERSION), 0, 0, 0, 0, 0, 0, 1, 255}},
+		{name: "constant out of bounds", data: []byte{'C', 'A', 'L', 'C', byte(BINARY_VERSION), 0, 0, 0, 0, 0, 0, 1, byte(OP_LOAD), 0}},
+	}
+	for i := 0; i < len(data); i++ {
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{name: "truncated", data: data[:i]})
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := (&Program{}).UnmarshalBinary(test.data)
+			assert.True(t, errors.Is(err, ErrInvalidBinary), "expected ErrInvalidBinary, got %v", err)
+		})
+	}
+}
+
+func TestBinaryInvalidSpans(t *testing.T) {
+	pos := func(offset, line, col int) Position { return Position{Offset: offset, Line: line, Col: col} }
+	tests := map[string]Span{
+		"column 0":            {Start: pos(0, 1, 0), End: pos(1, 1, 2)},
+		"line 0":              {Start: pos(0, 0, 1), End: pos(1, 1, 2)},
+		"offset after end":    {Start: pos(0, 1, 1), End: pos(9, 1, 2)},
+		"ends before start":   {Start: pos(2, 1, 3), End: pos(1, 1, 2)},
+		"column before start": {Start: pos(0, 1, 3), End: pos(1, 1, 2)},
+		"huge line":           {Start: pos(0, 1<<40, 1), End: pos(1, 1<<40, 2)},
+	}
+	for name, span := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &Program{Code: []Operation{{Code: OP_POP, Arg: 1}}, Spans: []Span{span}, Source: "1+2"}
+			data, err := p.MarshalBinary()
+			assert.NoError(t, err)
+			assert.ErrorIs(t, (&Program{}).UnmarshalBinary(data), ErrInvalidBinary)
+		})
+	}
+
+	p := &Program{Code: []Operation{{Code: OP_POP, Arg: 1}}, Spans: []Span{{Start: pos(0, 1, 1), End: pos(3, 1, 4)}}, Source: "1+2"}
+	data, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, (&Program{}).UnmarshalBinary(data))
+}
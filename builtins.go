@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// function implemented in go, callable as name(args...)
+type Builtin struct {
+	Name    string
+	MinArgs int
+	MaxArgs int // -1 for an unlimited amount of arguments
+	Fn      func(args []float64) float64
+}
+
+// returns an error if argc is not accepted by the builtin
+func (b *Builtin) checkArity(argc int) error {
+	if argc < b.MinArgs || (b.MaxArgs != -1 && argc > b.MaxArgs) {
+		return fmt.Errorf("%s expects %s, got %d", b.Name, b.arity(), argc)
+	}
+	return nil
+}
+
+// human readable amount of accepted arguments
+func (b *Builtin) arity() string {
+	switch {
+	case b.MaxArgs == -1:
+		return "at least " + arguments(b.MinArgs)
+	case b.MinArgs == b.MaxArgs:
+		return arguments(b.MinArgs)
+	default:
+		return fmt.Sprintf("%d to %s", b.MinArgs, arguments(b.MaxArgs))
+	}
+}
+
+// formats n as "1 argument" or "n arguments"
+func arguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
+// wraps a function of one argument
+func fn1(name string, fn func(float64) float64) Builtin {
+	return Builtin{Name: name, MinArgs: 1, MaxArgs: 1, Fn: func(args []float64) float64 {
+		return fn(args[0])
+	}}
+}
+
+// wraps a function of two arguments
+func fn2(name string, fn func(float64, float64) float64) Builtin {
+	return Builtin{Name: name, MinArgs: 2, MaxArgs: 2, Fn: func(args []float64) float64 {
+		return fn(args[0], args[1])
+	}}
+}
+
+// all builtins, the index of a builtin is the argument of OP_CALL
+var BUILTINS = []Builtin{
+	fn1("abs", math.Abs),
+	fn1("sqrt", math.Sqrt),
+	fn1("cbrt", math.Cbrt),
+	fn1("exp", math.Exp),
+	{Name: "log", MinArgs: 1, MaxArgs: 2, Fn: func(args []float64) float64 {
+		if len(args) == 2 {
+			return math.Log(args[0]) / math.Log(args[1])
+		}
+		return math.Log(args[0])
+	}},
+	fn1("log2", math.Log2),
+	fn1("log10", math.Log10),
+	fn1("sin", math.Sin),
+	fn1("cos", math.Cos),
+	fn1("tan", math.Tan),
+	fn1("asin", math.Asin),
+	fn1("acos", math.Acos),
+	fn1("atan", math.Atan),
+	fn2("atan2", math.Atan2),
+	fn1("sinh", math.Sinh),
+	fn1("cosh", math.Cosh),
+	fn1("tanh", math.Tanh),
+	fn1("floor", math.Floor),
+	fn1("ceil", math.Ceil),
+	fn1("round", math.Round),
+	fn1("trunc", math.Trunc),
+	fn2("hypot", math.Hypot),
+	{Name: "min", MinArgs: 1, MaxArgs: -1, Fn: func(args []float64) float64 {
+		m := args[0]
+		for _, a := range args[1:] {
+			m = math.Min(m, a)
+		}
+		return m
+	}},
+	{Name: "max", MinArgs: 1, MaxArgs: -1, Fn: func(args []float64) float64 {
+		m := args[0]
+		for _, a := range args[1:] {
+			m = math.Max(m, a)
+		}
+		return m
+	}},
+}
+
+// name of a builtin to its index in BUILTINS
+var builtinIndex = func() map[string]int {
+	m := make(map[string]int, len(BUILTINS))
+	for i, b := range BUILTINS {
+		m[b.Name] = i
+	}
+	return m
+}()
+
+// returns the index of the builtin in BUILTINS, false if there is none
+func lookupBuiltin(name string) (int, bool) {
+	i, ok := builtinIndex[name]
+	return i, ok
+}
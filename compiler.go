@@ -0,0 +1,136 @@
+package main
+
+// hands out the registers 1 to SPILL_REGISTER-1, register 0 holds results and
+// SPILL_REGISTER is reserved for values popped from the stack
+type RegisterAllocator struct {
+	registers [SPILL_REGISTER - 1]bool
+}
+
+// returns false if there are no more free registers, the caller has to spill
+// to the stack
+func (r *RegisterAllocator) alloc() (float64, bool) {
+	for i, v := range r.registers {
+		if v == false {
+			r.registers[i] = true
+			return float64(i + 1), true
+		}
+	}
+	return 0, false
+}
+
+func (r *RegisterAllocator) dealloc(index float64) {
+	i := int(index)
+	if r.registers[i-1] {
+		r.registers[i-1] = false
+	} else {
+		panic("Register not previously occupied")
+	}
+}
+
+// Compiler holds the state of a single compilation: the register allocator
+// and the parameters of the function body being compiled. Compile creates a
+// new Compiler for each call, therefore multiple goroutines can compile at
+// the same time, even into the same Env
+type Compiler struct {
+	env   *Env
+	alloc RegisterAllocator
+	scope *scope       // parameters of the function body currently compiled, nil at the top level
+	fn    *Function    // function whose body is currently compiled, not yet defined in env
+	needs map[Node]int // cache of need
+	spans []Span       // location of each operation of the chunk currently compiled
+
+	Peephole bool           // run the peephole optimizer over the operations and function bodies
+	Report   PeepholeReport // operations the peephole optimizer eliminated
+	Spans    []Span         // location in the input of each operation Compile returned
+}
+
+func NewCompiler(env *Env) *Compiler {
+	return &Compiler{env: env, needs: make(map[Node]int)}
+}
+
+// Sethi–Ullman number of n: the amount of registers besides register 0
+// computing n occupies. A binary operation keeps one operand in a register
+// while computing the other one, computing the operand with the greater need
+// first results in
+//
+//	need(l op r) = max(need(l), need(r)) if need(l) != need(r)
+//	need(l op r) = need(l) + 1           if need(l) == need(r)
+//
+// Arguments of calls are pushed onto the stack one after another, therefore
+// a call needs as many registers as its most demanding argument
+func (c *Compiler) need(n Node) int {
+	if need, ok := c.needs[n]; ok {
+		return need
+	}
+	need := 0
+	switch n := n.(type) {
+	case *Binary:
+		l, r := c.need(n.left), c.need(n.right)
+		if l == r {
+			need = l + 1
+		} else if l > r {
+			need = l
+		} else {
+			need = r
+		}
+	case *Unary:
+		need = c.need(n.right)
+	case *Assign:
+		need = c.need(n.value)
+	case *Call:
+		for _, arg := range n.args {
+			if argNeed := c.need(arg); argNeed > need {
+				need = argNeed
+			}
+		}
+	}
+	c.needs[n] = need
+	return need
+}
+
+// compiles all nodes to a list of operations, variables are declared in env,
+// returns the first error encountered
+func Compile(env *Env, n []Node) ([]Operation, error) {
+	return NewCompiler(env).Compile(n)
+}
+
+// compiles all nodes to a list of operations, returns the first error
+// encountered. The location of each operation is stored in Spans
+func (c *Compiler) Compile(n []Node) ([]Operation, error) {
+	c.spans = nil
+	o := make([]Operation, 0)
+	for _, node := range n {
+		codes, err := node.Compile(c)
+		if err != nil {
+			return nil, err
+		}
+		o = append(o, codes...)
+		// definitions have no result, like in Eval
+		if _, ok := node.(*FuncDef); !ok {
+			o = append(o, c.emit(node.Span(), Operation{Code: OP_RESULT})...)
+		}
+	}
+	o, c.Spans = c.optimize(o, c.spans)
+	return o, nil
+}
+
+// records span as the location of the operations, returns them. Nodes emit
+// their operations in the order they end up in the chunk, so the recorded
+// spans line up with the operations
+func (c *Compiler) emit(span Span, o ...Operation) []Operation {
+	for range o {
+		c.spans = append(c.spans, span)
+	}
+	return o
+}
+
+// runs the peephole optimizer over o and its spans if enabled, adds the
+// result to Report
+func (c *Compiler) optimize(o []Operation, spans []Span) ([]Operation, []Span) {
+	if !c.Peephole {
+		return o, spans
+	}
+	optimized, optimizedSpans, report := peephole(o, spans)
+	c.Report.add(report)
+	return optimized, optimizedSpans
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// run with 'go test -race' to detect data races between the goroutines
+
+func TestConcurrentPipeline(t *testing.T) {
+	// deep enough to use every register and spill to the stack
+	in := "f(x) = " + strings.Repeat("x*(", 20) + "1" + strings.Repeat(")", 20) + "\n" +
+		"y = f(2) + " + strings.Repeat("1+(", 20) + "1" + strings.Repeat(")", 20) + "\n" +
+		"y * 2"
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := NewLexer(strings.NewReader(in)).Lex()
+			assert.NoError(t, err)
+			ast, err := NewParser(token).Parse()
+			assert.NoError(t, err)
+
+			vm := Vm{env: NewEnv()}
+			ops, err := Compile(vm.env, ast)
+			assert.NoError(t, err)
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			assert.Equal(t, float64(2*(2<<19+21)), vm.reg[0])
+
+			result, err := Eval(NewEnv(), ast)
+			assert.NoError(t, err)
+			assert.Equal(t, float64(2*(2<<19+21)), result)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentSharedEnv(t *testing.T) {
+	env := NewEnv()
+	assert.NoError(t, env.Set("base", 10))
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// every goroutine uses its own names, the symbols of the env
+			// are shared
+			name := fmt.Sprintf("v%d", i)
+			fn := fmt.Sprintf("f%d", i)
+			ast := parse(t, fmt.Sprintf("%s(x) = x + base\n%s = %s(%d)\n%s", fn, name, fn, i, name))
+
+			ops, err := Compile(env, ast)
+			assert.NoError(t, err)
+			vm := Vm{env: env}
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			assert.Equal(t, float64(i+10), vm.reg[0])
+
+			result, err := Eval(env, ast)
+			assert.NoError(t, err)
+			assert.Equal(t, float64(i+10), result)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 32; i++ {
+		val, ok := env.Get(fmt.Sprintf("v%d", i))
+		assert.True(t, ok)
+		assert.Equal(t, float64(i+10), val)
+	}
+}
+
+func TestConcurrentRedefinition(t *testing.T) {
+	env := NewEnv()
+	_, err := Compile(env, parse(t, "f(x) = x + 1"))
+	assert.NoError(t, err)
+	call, err := Compile(env, parse(t, "f(1)"))
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			// a long body widens the window between starting and completing
+			// the definition
+			_, err := Compile(env, parse(t, fmt.Sprintf("f(x) = x + %d%s", i%2+1, strings.Repeat(" + 0 * x", 200))))
+			assert.NoError(t, err)
+		}
+	}()
+	// calls during the redefinition execute the previous definition
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		vm := Vm{env: env}
+		if !assert.NoError(t, vm.NewVmIn(call).Execute()) {
+			<-done
+			return
+		}
+		assert.Contains(t, []float64{2, 3}, vm.Results()[0])
+	}
+}
+
+func TestCompileSpans(t *testing.T) {
+	in := "x = 2\nf(a) = -a + 1\nf(x) * (x - 3)"
+	for _, peephole := range []bool{false, true} {
+		env := NewEnv()
+		compiler := NewCompiler(env)
+		compiler.Peephole = peephole
+		code, err := compiler.Compile(parse(t, in))
+		assert.NoError(t, err)
+		assert.Len(t, compiler.Spans, len(code))
+		f := env.function(0)
+		assert.Len(t, f.Spans, len(f.Code))
+
+		texts := make([]string, len(code))
+		for i, s := range compiler.Spans {
+			texts[i] = in[s.Start.Offset:s.End.Offset]
+		}
+		assert.Equal(t, "x = 2", texts[1])
+		assert.Equal(t, "f(a) = -a + 1", in[f.Spans[len(f.Spans)-1].Start.Offset:f.Spans[len(f.Spans)-1].End.Offset])
+		assert.Equal(t, "f(x) * (x - 3)", texts[len(texts)-1])
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// why Continue stopped
+type StopReason int
+
+const (
+	STOP_END        StopReason = iota // the vm executed all operations
+	STOP_BREAKPOINT                   // the next operation is at a breakpoint
+	STOP_OPCODE                       // the next operation has an opcode with a breakpoint
+	STOP_WATCHPOINT                   // the last operation changed a watched register
+)
+
+// returned by Continue, Register, Old and New are set for STOP_WATCHPOINT
+type Stop struct {
+	Reason   StopReason
+	Register int
+	Old, New float64
+}
+
+// position of an operation, Function is empty for the main code
+type breakpoint struct {
+	Function string
+	Pc       int
+}
+
+// Debugger executes a program operation by operation and stops at
+// breakpoints on positions and opcodes and at changes of watched registers
+type Debugger struct {
+	vm          *Vm
+	program     *Program
+	breakpoints map[breakpoint]bool
+	opcodes     map[OpCode]bool
+	watches     map[int]bool
+	err         error // error the vm failed with, execution can not continue
+}
+
+// creates a debugger for p, loads p into env
+func NewDebugger(env *Env, p *Program) (*Debugger, error) {
+	if err := p.Load(env); err != nil {
+		return nil, err
+	}
+	vm := &Vm{env: env}
+	vm.NewVmIn(p.Code)
+	return &Debugger{
+		vm:          vm,
+		program:     p,
+		breakpoints: make(map[breakpoint]bool),
+		opcodes:     make(map[OpCode]bool),
+		watches:     make(map[int]bool),
+	}, nil
+}
+
+// stops before executing the operation at pc of the function, or of the
+// main code if function is empty
+func (d *Debugger) BreakAt(function string, pc int) error {
+	code := d.program.Code
+	if function != "" {
+		fn := d.function(function)
+		if fn == nil {
+			return fmt.Errorf("unknown function %q", function)
+		}
+		code = fn.Code
+	}
+	if pc < 0 || pc >= len(code) {
+		return fmt.Errorf("no operation at %d", pc)
+	}
+	d.breakpoints[breakpoint{function, pc}] = true
+	return nil
+}
+
+// stops before executing any operation with the opcode
+func (d *Debugger) BreakOn(code OpCode) {
+	d.opcodes[code] = true
+}
+
+// stops after an operation changed the register
+func (d *Debugger) Watch(register int) error {
+	if register < 0 || register >= REGISTER_COUNT {
+		return fmt.Errorf("register %d out of bounds, the vm has %d registers", register, REGISTER_COUNT)
+	}
+	d.watches[register] = true
+	return nil
+}
+
+// removes all breakpoints and watchpoints
+func (d *Debugger) Clear() {
+	d.breakpoints = make(map[breakpoint]bool)
+	d.opcodes = make(map[OpCode]bool)
+	d.watches = make(map[int]bool)
+}
+
+// reports if the program finished or failed
+func (d *Debugger) Done() bool {
+	return d.vm.Done() || d.err != nil
+}
+
+// registers of the vm
+func (d *Debugger) Registers() [REGISTER_COUNT]float64 {
+	return d.vm.reg
+}
+
+// results the program emitted so far
+func (d *Debugger) Results() []float64 {
+	return d.vm.Results()
+}
+
+// executes the next operation, see Vm.Step
+func (d *Debugger) Step() error {
+	if d.err != nil {
+		return d.err
+	}
+	d.err = d.vm.Step()
+	return d.err
+}
+
+// executes operations until the program is done, the next operation is at a
+// breakpoint or an operation changed a watched register. Always executes at
+// least one operation, so continuing from a breakpoint does not stop at it
+// again
+func (d *Debugger) Continue() (Stop, error) {
+	for first := true; !d.Done(); first = false {
+		if !first {
+			if d.breakpoints[d.position()] {
+				return Stop{Reason: STOP_BREAKPOINT}, nil
+			}
+			if d.opcodes[d.vm.cur().Code] {
+				return Stop{Reason: STOP_OPCODE}, nil
+			}
+		}
+		before := d.vm.reg
+		if err := d.Step(); err != nil {
+			return Stop{}, err
+		}
+		for r := 0; r < REGISTER_COUNT; r++ {
+			if d.watches[r] && !sameFloat(before[r], d.vm.reg[r]) {
+				return Stop{Reason: STOP_WATCHPOINT, Register: r, Old: before[r], New: d.vm.reg[r]}, nil
+			}
+		}
+	}
+	return Stop{Reason: STOP_END}, d.err
+}
+
+// position of the next operation
+func (d *Debugger) position() breakpoint {
+	function, pc := d.vm.location()
+	return breakpoint{function, pc}
+}
+
+func (d *Debugger) function(name string) *Function {
+	for _, f := range d.program.Functions {
+		if f != nil && !f.declaration() && f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// operations and spans of the chunk the next operation belongs to
+func (d *Debugger) chunk() ([]Operation, []Span) {
+	function, _ := d.vm.location()
+	if function == "" {
+		return d.program.Code, d.program.Spans
+	}
+	f := d.function(function)
+	return f.Code, f.Spans
+}
+
+// writes the next operation and the part of the source it was compiled from
+func (d *Debugger) Where(w io.Writer) {
+	if d.err != nil {
+		fmt.Fprintln(w, "program failed")
+		return
+	}
+	if d.Done() {
+		results := make([]string, len(d.vm.results))
+		for i, v := range d.vm.results {
+			results[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "program finished, results: %s\n", strings.Join(results, ", "))
+		return
+	}
+	code, spans := d.chunk()
+	function, pc := d.vm.location()
+	b := &strings.Builder{}
+	disassembleChunk(b, d.program, code[pc:pc+1], nil, "")
+	line := strings.TrimSuffix(b.String(), "\n")
+	// disassembleChunk numbers the single operation with 0
+	line = fmt.Sprintf("%04d%s", pc, line[4:])
+	if function != "" {
+		line += " (in " + function + ")"
+	}
+	fmt.Fprintln(w, line)
+	if len(spans) == len(code) && spans[pc].Start.Line > 0 {
+		lines := strings.Split(d.program.Source, "\n")
+		if spans[pc].Start.Line <= len(lines) {
+			gutter := len(strconv.Itoa(spans[pc].Start.Line))
+			renderExcerpt(w, lines, 1, gutter, spans[pc], '^', '~', "")
+		}
+	}
+}
+
+// writes the operations of the current chunk, marks the next operation with
+// '=>' and operations with a breakpoint with '*'
+func (d *Debugger) List(w io.Writer) {
+	code, spans := d.chunk()
+	function, pc := d.vm.location()
+	b := &strings.Builder{}
+	disassembleChunk(b, d.program, code, spans, d.program.Source)
+	for i, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		marker := "   "
+		switch {
+		case i == pc && !d.Done():
+			marker = "=> "
+		case d.breakpoints[breakpoint{function, i}] || (i < len(code) && d.opcodes[code[i].Code]):
+			marker = " * "
+		}
+		fmt.Fprintln(w, marker+line)
+	}
+}
+
+// writes all registers to w, four per line
+func (d *Debugger) Regs(w io.Writer) {
+	line := ""
+	for r := 0; r < REGISTER_COUNT; r++ {
+		line += fmt.Sprintf("r%-2d %-16v", r, d.vm.reg[r])
+		if r%4 == 3 || r == REGISTER_COUNT-1 {
+			fmt.Fprintln(w, strings.TrimRight(line, " "))
+			line = ""
+		}
+	}
+}
+
+const DEBUGGER_HELP = `commands:
+  step [n], s      execute the next n operations, defaults to 1
+  continue, c      execute until a breakpoint, a watchpoint or the end
+  break <pc>, b    stop before the operation at pc of the main code
+  break <fn> <pc>  stop before the operation at pc of function fn
+  break <opcode>   stop before every operation with the opcode, e.g. OP_ADD
+  watch <reg>, w   stop after an operation changed the register, e.g. r1
+  clear            remove all breakpoints and watchpoints
+  regs, r          print the registers
+  stack            print the values on the stack
+  list, l          print the operations of the current function
+  where            print the next operation and its source
+  help, h          print this help
+  quit, q          stop debugging
+an empty line repeats the last command`
+
+// reads commands from in until the input ends or the user quits, writes the
+// output of the commands to out
+func (d *Debugger) Run(in io.Reader, out io.Writer) {
+	d.Where(out)
+	scanner := bufio.NewScanner(in)
+	last := ""
+	for {
+		fmt.Fprint(out, "(debug) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			line = last
+		}
+		last = line
+		if line == "" {
+			continue
+		}
+		if !d.command(strings.Fields(line), out) {
+			return
+		}
+	}
+}
+
+// executes a single command, returns false if the user quit
+func (d *Debugger) command(args []string, out io.Writer) bool {
+	switch args[0] {
+	case "step", "s":
+		n := 1
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				fmt.Fprintf(out, "invalid amount of steps %q\n", args[1])
+				return true
+			}
+		}
+		for i := 0; i < n && !d.Done(); i++ {
+			if err := d.Step(); err != nil {
+				RenderError(out, d.program.Source, err)
+				return true
+			}
+		}
+		d.Where(out)
+	case "continue", "c":
+		stop, err := d.Continue()
+		if err != nil {
+			RenderError(out, d.program.Source, err)
+			return true
+		}
+		switch stop.Reason {
+		case STOP_BREAKPOINT, STOP_OPCODE:
+			fmt.Fprintln(out, "breakpoint")
+		case STOP_WATCHPOINT:
+			fmt.Fprintf(out, "watchpoint r%d: %v -> %v\n", stop.Register, stop.Old, stop.New)
+		}
+		d.Where(out)
+	case "break", "b":
+		d.breakCommand(args[1:], out)
+	case "watch", "w":
+		if len(args) != 2 {
+			fmt.Fprintln(out, "usage: watch <register>")
+			return true
+		}
+		r, err := strconv.Atoi(strings.TrimPrefix(args[1], "r"))
+		if err == nil {
+			err = d.Watch(r)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "invalid register %q\n", args[1])
+		}
+	case "clear":
+		d.Clear()
+	case "regs", "r":
+		d.Regs(out)
+	case "stack":
+		fmt.Fprintln(out, d.vm.stack)
+	case "list", "l":
+		d.List(out)
+	case "where":
+		d.Where(out)
+	case "help", "h":
+		fmt.Fprintln(out, DEBUGGER_HELP)
+	case "quit", "q":
+		return false
+	default:
+		fmt.Fprintf(out, "unknown command %q, see 'help'\n", args[0])
+	}
+	return true
+}
+
+func (d *Debugger) breakCommand(args []string, out io.Writer) {
+	switch len(args) {
+	case 1:
+		if code, ok := opByName[strings.TrimPrefix(strings.ToUpper(args[0]), "OP_")]; ok {
+			d.BreakOn(code)
+			return
+		}
+		pc, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(out, "expected a position or an opcode, got %q\n", args[0])
+			return
+		}
+		if err := d.BreakAt("", pc); err != nil {
+			fmt.Fprintln(out, err)
+		}
+	case 2:
+		pc, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintf(out, "expected a position, got %q\n", args[1])
+			return
+		}
+		if err := d.BreakAt(args[0], pc); err != nil {
+			fmt.Fprintln(out, err)
+		}
+	default:
+		fmt.Fprintln(out, "usage: break <pc>, break <function> <pc> or break <opcode>")
+	}
+}
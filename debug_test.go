@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDebugger(t *testing.T, in string) *Debugger {
+	t.Helper()
+	p := compileProgram(t, in)
+	p.Source = in
+	d, err := NewDebugger(NewEnv(), p)
+	assert.NoError(t, err)
+	return d
+}
+
+func TestDebuggerStep(t *testing.T) {
+	d := newTestDebugger(t, "f(x) = x*2\ny = f(20) + 2")
+	steps := 0
+	for !d.Done() {
+		assert.NoError(t, d.Step())
+		steps++
+	}
+	assert.Equal(t, 10, steps)
+	assert.Equal(t, float64(42), d.Registers()[0])
+	assert.NoError(t, d.Step())
+
+	stop, err := d.Continue()
+	assert.NoError(t, err)
+	assert.Equal(t, STOP_END, stop.Reason)
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	d := newTestDebugger(t, "f(x) = x*2\ny = f(20) + 2\ny * 3")
+	assert.NoError(t, d.BreakAt("", 4))
+	assert.NoError(t, d.BreakAt("f", 1))
+	d.BreakOn(OP_MULTIPYI)
+
+	expected := []struct {
+		reason   StopReason
+		function string
+		pc       int
+	}{
+		{STOP_BREAKPOINT, "f", 1},
+		{STOP_BREAKPOINT, "", 4},
+		{STOP_OPCODE, "", 7},
+		{STOP_END, "", 8},
+	}
+	for _, e := range expected {
+		stop, err := d.Continue()
+		assert.NoError(t, err)
+		assert.Equal(t, e.reason, stop.Reason)
+		function, pc := d.vm.location()
+		assert.Equal(t, e.function, function)
+		assert.Equal(t, e.pc, pc)
+	}
+	assert.Equal(t, []float64{42, 126}, d.Results())
+}
+
+func TestDebuggerBreakAtErrors(t *testing.T) {
+	d := newTestDebugger(t, "f(x) = x\nf(1)")
+	assert.Error(t, d.BreakAt("", 10))
+	assert.Error(t, d.BreakAt("", -1))
+	assert.Error(t, d.BreakAt("g", 0))
+	assert.Error(t, d.BreakAt("f", 2))
+	assert.Error(t, d.Watch(REGISTER_COUNT))
+}
+
+func TestDebuggerWatch(t *testing.T) {
+	d := newTestDebugger(t, "1-2*3")
+	d.vm.in = []Operation{{OP_LOAD, 2}, {OP_STORE, 1}, {OP_LOAD, 3}, {OP_MULTIPY, 1}, {OP_STORE, 1}, {OP_LOAD, 1}, {OP_RSUBTRACT, 1}}
+	assert.NoError(t, d.Watch(1))
+
+	stop, err := d.Continue()
+	assert.NoError(t, err)
+	assert.Equal(t, Stop{Reason: STOP_WATCHPOINT, Register: 1, Old: 0, New: 2}, stop)
+	stop, err = d.Continue()
+	assert.NoError(t, err)
+	assert.Equal(t, Stop{Reason: STOP_WATCHPOINT, Register: 1, Old: 2, New: 6}, stop)
+	stop, err = d.Continue()
+	assert.NoError(t, err)
+	assert.Equal(t, STOP_END, stop.Reason)
+	assert.Equal(t, float64(-5), d.Registers()[0])
+}
+
+func TestDebuggerError(t *testing.T) {
+	d := newTestDebugger(t, "1")
+	d.vm.in = []Operation{{OP_POP, 1}, {OP_LOAD, 1}}
+	_, err := d.Continue()
+	assert.Error(t, err)
+	assert.True(t, d.Done())
+	assert.Equal(t, err, d.Step())
+}
+
+func TestDebuggerRun(t *testing.T) {
+	d := newTestDebugger(t, "f(x) = x+1\nf(2) * 3")
+	out := &strings.Builder{}
+	d.Run(strings.NewReader("break f 0\nc\nstep\n\nregs\nc\nbreak x\nq\nstep\n"), out)
+	assert.Equal(t, strings.Join([]string{
+		"0000  OP_LOAD           2",
+		"2 | f(2) * 3",
+		"  |   ^",
+		"(debug) (debug) breakpoint",
+		"0000  OP_LOAD_LOCAL     0 (in f)",
+		"1 | f(x) = x+1",
+		"  |        ^",
+		"(debug) 0001  OP_ADDI           1 (in f)",
+		"1 | f(x) = x+1",
+		"  |        ^~~",
+		"(debug) 0002  OP_RETURN (in f)",
+		"1 | f(x) = x+1",
+		"  | ^~~~~~~~~~",
+		"(debug) r0  3               r1  0               r2  0               r3  0",
+		"r4  0               r5  0               r6  0               r7  0",
+		"r8  0               r9  0               r10 0               r11 0",
+		"r12 0               r13 0               r14 0               r15 0",
+		"(debug) program finished, results: 9",
+		"(debug) expected a position or an opcode, got \"x\"",
+		"(debug) ",
+	}, "\n"), out.String())
+}
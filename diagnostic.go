@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// stable identifiers for every kind of error, included in rendered diagnostics
+const (
+	CODE_UNKNOWN_CHARACTER   = "E001"
+	CODE_EXPECTED_EXPRESSION = "E002"
+	CODE_UNEXPECTED_TOKEN    = "E003"
+	CODE_UNCLOSED_BRACE      = "E004"
+	CODE_UNMATCHED_BRACE     = "E005"
+	CODE_INVALID_NUMBER      = "E006"
+	// E007 is retired, it was reported for expressions needing more
+	// registers than the vm has, the compiler spills to the stack instead
+	CODE_INTERNAL             = "E008"
+	CODE_RUNTIME              = "E009"
+	CODE_UNDEFINED_VARIABLE   = "E010"
+	CODE_UNKNOWN_FUNCTION     = "E011"
+	CODE_ARITY                = "E012"
+	CODE_CONSTANT_ASSIGNMENT  = "E013"
+	CODE_BUILTIN_REDEFINITION = "E014"
+	CODE_INVALID_PARAMETER    = "E015"
+	CODE_STACK_OVERFLOW       = "E016"
+	CODE_ASSEMBLY             = "E017"
+	CODE_VERIFY               = "E018"
+	CODE_BUDGET               = "E019"
+)
+
+// secondary location attached to a diagnostic, for instance the opening
+// parenthesis of an unclosed group
+type Label struct {
+	Span Span
+	Msg  string
+}
+
+// Diagnostic is the user facing representation of an error. Rendering a
+// diagnostic prints the offending line of the input and underlines the span
+// the error occurred at:
+//
+//	error[E004]: expected ')' to close group, got end of input
+//	 --> 1:5
+//	  |
+//	1 | (1+2
+//	  |     ^ expected ')'
+//	  |
+//	1 | (1+2
+//	  | - unclosed parenthesis opened here
+//	  = hint: add a ')' after the expression
+type Diagnostic struct {
+	Code   string  // one of CODE_*
+	Msg    string  // description of the error
+	Span   Span    // location of the error, zero if the error has no location
+	Note   string  // printed next to the underline of Span, may be empty
+	Labels []Label // secondary locations
+	Hint   string  // suggestion on how to fix the error, may be empty
+}
+
+// implemented by errors that can be rendered as a diagnostic
+type Diagnoser interface {
+	error
+	Diagnostic() *Diagnostic
+}
+
+// renders err as a diagnostic with excerpts of src, falls back to the error
+// message if err does not implement Diagnoser. Each error of an ErrorList is
+// rendered separately
+func RenderError(w io.Writer, src string, err error) {
+	renderError(w, strings.Split(src, "\n"), 1, err)
+}
+
+// like RenderError, lines are the lines of the input starting at line number
+// first. Renders a single line of a long input without splitting all of it
+func renderError(w io.Writer, lines []string, first int, err error) {
+	var list ErrorList
+	if errors.As(err, &list) {
+		for i, e := range list {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			renderError(w, lines, first, e)
+		}
+		return
+	}
+	var d Diagnoser
+	if errors.As(err, &d) {
+		d.Diagnostic().render(w, lines, first)
+		return
+	}
+	fmt.Fprintf(w, "error: %s\n", err)
+}
+
+// writes the diagnostic and excerpts of src to w
+func (d *Diagnostic) Render(w io.Writer, src string) {
+	d.render(w, strings.Split(src, "\n"), 1)
+}
+
+func (d *Diagnostic) render(w io.Writer, lines []string, first int) {
+	fmt.Fprintf(w, "error[%s]: %s\n", d.Code, d.Msg)
+	if d.Span.Start.Line < 1 {
+		if d.Hint != "" {
+			fmt.Fprintf(w, "  = hint: %s\n", d.Hint)
+		}
+		return
+	}
+
+	gutter := len(strconv.Itoa(d.Span.Start.Line))
+	for _, l := range d.Labels {
+		if g := len(strconv.Itoa(l.Span.Start.Line)); g > gutter {
+			gutter = g
+		}
+	}
+	pad := strings.Repeat(" ", gutter)
+
+	fmt.Fprintf(w, "%s--> %s\n", pad, d.Span.Start)
+	fmt.Fprintf(w, "%s |\n", pad)
+	renderExcerpt(w, lines, first, gutter, d.Span, '^', '~', d.Note)
+	for _, l := range d.Labels {
+		fmt.Fprintf(w, "%s |\n", pad)
+		renderExcerpt(w, lines, first, gutter, l.Span, '-', '-', l.Msg)
+	}
+	if d.Hint != "" {
+		fmt.Fprintf(w, "%s = hint: %s\n", pad, d.Hint)
+	}
+}
+
+// prints the line span starts on and underlines the span, spans covering
+// multiple lines are underlined until the end of their first line. Spans
+// outside of lines are clamped to the line. lines start at line number
+// firstLine
+func renderExcerpt(w io.Writer, lines []string, firstLine, gutter int, span Span, first, rest rune, note string) {
+	line := ""
+	if i := span.Start.Line - firstLine; i >= 0 && i < len(lines) {
+		line = strings.TrimSuffix(lines[i], "\r")
+	}
+	// tabs would break the alignment of the underline
+	line = strings.ReplaceAll(line, "\t", " ")
+	length := len([]rune(line))
+
+	// the underline may point after the last character, e.g. at the end of
+	// the input
+	col := span.Start.Col
+	if col < 1 {
+		col = 1
+	} else if col > length+1 {
+		col = length + 1
+	}
+	width := 1
+	if span.End.Line == span.Start.Line && span.End.Col > col {
+		width = span.End.Col - col
+	} else if span.End.Line > span.Start.Line && length > col {
+		width = length - col + 1
+	}
+	if rest := length - col + 1; width > rest {
+		width = rest
+	}
+	if width < 1 {
+		width = 1
+	}
+
+	underline := strings.Builder{}
+	underline.WriteString(strings.Repeat(" ", col-1))
+	underline.WriteRune(first)
+	underline.WriteString(strings.Repeat(string(rest), width-1))
+	if note != "" {
+		underline.WriteString(" ")
+		underline.WriteString(note)
+	}
+
+	fmt.Fprintf(w, "%*d | %s\n", gutter, span.Start.Line, line)
+	fmt.Fprintf(w, "%*s | %s\n", gutter, "", underline.String())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderError(t *testing.T) {
+	tests := []struct {
+		Name string
+		In   string
+		Out  string
+	}{
+		{
+			Name: "unknown character",
+			In:   "1 + $",
+			Out: `error[E001]: unknown character '$'
+ --> 1:5
+  |
+1 | 1 + $
+  |     ^ not part of the language
+  = hint: supported are numbers, variables, functions, '=', '+', '-', '*', '/', '//', '%', '^', '**', '(', ')', ',' and comments starting with '#'
+`,
+		},
+		{
+			Name: "unclosed brace",
+			In:   "(1+2",
+			Out: `error[E004]: expected ')' to close group, got end of input
+ --> 1:5
+  |
+1 | (1+2
+  |     ^ expected ')'
+  |
+1 | (1+2
+  | - unclosed parenthesis opened here
+  = hint: add a ')' after the expression
+`,
+		},
+		{
+			Name: "span underline",
+			In:   "2 * 1.2.3",
+			Out: `error[E006]: invalid number "1.2.3": strconv.ParseFloat: parsing "1.2.3": invalid syntax
+ --> 1:5
+  |
+1 | 2 * 1.2.3
+  |     ^~~~~
+  = hint: numbers consist of digits, a single '.', '_' as separator and 'e' for the exponent
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			token, err := NewLexer(strings.NewReader(test.In)).Lex()
+			if err == nil {
+				var ast []Node
+				ast, err = NewParser(token).Parse()
+				if err == nil {
+					_, err = Compile(NewEnv(), ast)
+				}
+			}
+			assert.Error(t, err)
+			b := strings.Builder{}
+			RenderError(&b, test.In, err)
+			assert.Equal(t, test.Out, b.String())
+		})
+	}
+}
+
+func TestRenderErrorFallback(t *testing.T) {
+	b := strings.Builder{}
+	RenderError(&b, "", errors.New("something went wrong"))
+	assert.Equal(t, "error: something went wrong\n", b.String())
+}
+
+func TestRenderExcerptClamps(t *testing.T) {
+	pos := func(line, col int) Position { return Position{Line: line, Col: col} }
+	tests := []struct {
+		name string
+		span Span
+		exp  string
+	}{
+		{"column 0", Span{Start: pos(1, 0), End: pos(1, 3)}, "1 | 1+2\n  | ^~\n"},
+		{"negative column", Span{Start: pos(1, -5), End: pos(1, -2)}, "1 | 1+2\n  | ^\n"},
+		{"column after the line", Span{Start: pos(1, 40), End: pos(1, 50)}, "1 | 1+2\n  |    ^\n"},
+		{"end after the line", Span{Start: pos(1, 2), End: pos(1, 1000)}, "1 | 1+2\n  |  ^~\n"},
+		{"negative line", Span{Start: pos(-3, 1), End: pos(-3, 2)}, "-3 | \n  | ^\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &strings.Builder{}
+			renderExcerpt(b, []string{"1+2"}, 1, 1, test.span, '^', '~', "")
+			assert.Equal(t, test.exp, b.String())
+		})
+	}
+	assert.Equal(t, "", excerpt("1+2", Span{Start: Position{Offset: -1}, End: Position{Offset: 2}}))
+}
+
+func TestRenderErrorFirstLine(t *testing.T) {
+	err := &CompileError{Span: Span{Start: Position{Line: 1000, Col: 3}, End: Position{Line: 1000, Col: 4}}, Code: CODE_UNDEFINED_VARIABLE, Msg: "undefined variable \"x\""}
+	b := strings.Builder{}
+	renderError(&b, []string{"1+x"}, 1000, err)
+	assert.Equal(t, "error[E010]: undefined variable \"x\"\n    --> 1000:3\n     |\n1000 | 1+x\n     |   ^\n", b.String())
+}
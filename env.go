@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// constants every new environment starts with
+var CONSTANTS = map[string]float64{
+	"pi":  math.Pi,
+	"e":   math.E,
+	"tau": 2 * math.Pi,
+	"phi": math.Phi,
+	"inf": math.Inf(1),
+	"nan": math.NaN(),
+}
+
+// a named value in the environment
+type variable struct {
+	name     string
+	value    float64
+	assigned bool // false if the variable was declared by the compiler but never assigned at runtime
+}
+
+// Env is the symbol table of variables. The compiler declares a slot for each
+// assigned variable and emits its index as the argument of OP_LOAD_GLOBAL and
+// OP_STORE_GLOBAL, the vm reads and writes the value of that slot. The tree
+// walk interpreter accesses variables by name.
+//
+// Constants can not be assigned to, the compiler replaces references to
+// them with their value.
+//
+// An Env outlives a single call to Compile, Vm.Execute or Eval, therefore
+// later input can reference variables assigned by earlier input. It is safe
+// for concurrent use by multiple goroutines.
+type Env struct {
+	mu        sync.RWMutex
+	vars      []variable
+	slots     map[string]int // variable name to index into vars
+	consts    map[string]float64
+	funcs     []*Function
+	funcSlots map[string]int // function name to index into funcs
+}
+
+// user defined function, Body is used by the tree walk interpreter, Code is
+// the compiled body executed by the vm. A Function is not modified once
+// defined in an Env, redefining replaces it.
+type Function struct {
+	Name   string
+	Params []string
+	Body   Node
+	Code   []Operation // nil if the function was never compiled
+	Spans  []Span      // location in the input of each operation of Code, may be nil
+}
+
+// reports if the function is only declared: it was called in the body of
+// another function but never defined. A declaration has a Name, neither Body
+// nor Code
+func (f *Function) declaration() bool {
+	return f.Body == nil && f.Code == nil
+}
+
+// returns an error if argc does not match the amount of parameters
+func (f *Function) checkArity(argc int) error {
+	if argc != len(f.Params) {
+		return fmt.Errorf("%s expects %s, got %d", f.Name, arguments(len(f.Params)), argc)
+	}
+	return nil
+}
+
+// scope containing the parameters of the function, without values
+func (f *Function) scope() *scope {
+	params := make(map[string]int, len(f.Params))
+	for i, p := range f.Params {
+		params[p] = i
+	}
+	return &scope{params: params}
+}
+
+// parameters of a function, by name to index in values. While compiling
+// values is nil
+type scope struct {
+	params map[string]int
+	values []float64
+}
+
+// max amount of nested calls of user defined functions
+const MAX_CALL_DEPTH int = 256
+
+// creates an environment containing CONSTANTS
+func NewEnv() *Env {
+	e := &Env{
+		vars:      make([]variable, 0),
+		slots:     make(map[string]int),
+		consts:    make(map[string]float64, len(CONSTANTS)),
+		funcs:     make([]*Function, 0),
+		funcSlots: make(map[string]int),
+	}
+	for name, value := range CONSTANTS {
+		e.consts[name] = value
+	}
+	return e
+}
+
+// defines a constant, errors if a variable or constant with the name exists
+func (e *Env) DefineConst(name string, value float64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.consts[name]; ok {
+		return fmt.Errorf("constant %q is already defined", name)
+	}
+	if _, ok := e.slots[name]; ok {
+		return fmt.Errorf("%q is already defined as a variable", name)
+	}
+	e.consts[name] = value
+	return nil
+}
+
+// returns the value of the constant, false if there is no constant with the
+// name
+func (e *Env) Const(name string) (float64, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	value, ok := e.consts[name]
+	return value, ok
+}
+
+// returns the slot of the variable, declares it if not found
+func (e *Env) declare(name string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if slot, ok := e.slots[name]; ok {
+		return slot
+	}
+	e.vars = append(e.vars, variable{name: name})
+	e.slots[name] = len(e.vars) - 1
+	return len(e.vars) - 1
+}
+
+// returns the slot of the variable, false if not declared
+func (e *Env) lookup(name string) (int, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	slot, ok := e.slots[name]
+	return slot, ok
+}
+
+// returns the value at slot, false if slot is out of bounds or was never
+// assigned
+func (e *Env) load(slot int) (float64, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if slot < 0 || slot >= len(e.vars) || !e.vars[slot].assigned {
+		return 0, false
+	}
+	return e.vars[slot].value, true
+}
+
+// assigns value to the variable at slot, false if slot is out of bounds
+func (e *Env) store(slot int, value float64) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if slot < 0 || slot >= len(e.vars) {
+		return false
+	}
+	e.vars[slot].value = value
+	e.vars[slot].assigned = true
+	return true
+}
+
+// returns the name of the variable at slot, empty if out of bounds
+func (e *Env) name(slot int) string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if slot < 0 || slot >= len(e.vars) {
+		return ""
+	}
+	return e.vars[slot].name
+}
+
+// returns the value of the variable or constant, false if it is not assigned
+func (e *Env) Get(name string) (float64, bool) {
+	if value, ok := e.Const(name); ok {
+		return value, true
+	}
+	slot, ok := e.lookup(name)
+	if !ok {
+		return 0, false
+	}
+	return e.load(slot)
+}
+
+// assigns value to the variable, declares it if necessary, errors if name is
+// a constant
+func (e *Env) Set(name string, value float64) error {
+	if _, ok := e.Const(name); ok {
+		return fmt.Errorf("can not assign to constant %q", name)
+	}
+	e.store(e.declare(name), value)
+	return nil
+}
+
+// defines or redefines the function, returns its slot
+func (e *Env) defineFunc(f *Function) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if slot, ok := e.funcSlots[f.Name]; ok {
+		e.funcs[slot] = f
+		return slot
+	}
+	e.funcs = append(e.funcs, f)
+	e.funcSlots[f.Name] = len(e.funcs) - 1
+	return len(e.funcs) - 1
+}
+
+// returns the slot of the function, false if not defined
+func (e *Env) lookupFunc(name string) (int, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	slot, ok := e.funcSlots[name]
+	return slot, ok
+}
+
+// returns the function at slot, nil if out of bounds
+func (e *Env) function(slot int) *Function {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if slot < 0 || slot >= len(e.funcs) {
+		return nil
+	}
+	return e.funcs[slot]
+}
+
+// returns the slot of the function, reserves a slot without a function if it
+// is not defined. Function bodies call functions defined after them through
+// the reserved slot, defining the function fills it
+func (e *Env) declareFunc(name string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if slot, ok := e.funcSlots[name]; ok {
+		return slot
+	}
+	e.funcs = append(e.funcs, nil)
+	e.funcSlots[name] = len(e.funcs) - 1
+	return len(e.funcs) - 1
+}
+
+// name of the function or of the declared function at slot, empty if none
+func (e *Env) funcName(slot int) string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for name, s := range e.funcSlots {
+		if s == slot {
+			return name
+		}
+	}
+	return ""
+}
+
+// removes the function, used to discard a definition that failed to compile.
+// Its slot is only reused if it is the last one, since compiled code of other
+// goroutines may reference the later slots
+func (e *Env) undefineFunc(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	slot, ok := e.funcSlots[name]
+	if !ok {
+		return
+	}
+	delete(e.funcSlots, name)
+	if slot == len(e.funcs)-1 {
+		e.funcs = e.funcs[:slot]
+	} else {
+		e.funcs[slot] = nil
+	}
+}
+
+// appends a slot without a function, returns its slot. Unless name is empty
+// the slot is declared for the function, see declareFunc
+func (e *Env) reserveFunc(name string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.funcs = append(e.funcs, nil)
+	if name != "" {
+		e.funcSlots[name] = len(e.funcs) - 1
+	}
+	return len(e.funcs) - 1
+}
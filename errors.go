@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// returned by the lexer if it encounters a character it can not tokenize
+type LexError struct {
+	Rune rune // the offending character
+	Span Span // location of the offending character
+}
+
+func (e *LexError) Error() string {
+	return fmt.Sprintf("lexer: unknown %q in input at %s", e.Rune, e.Span.Start)
+}
+
+func (e *LexError) Diagnostic() *Diagnostic {
+	return &Diagnostic{
+		Code: CODE_UNKNOWN_CHARACTER,
+		Msg:  fmt.Sprintf("unknown character %q", e.Rune),
+		Span: e.Span,
+		Note: "not part of the language",
+		Hint: "supported are numbers, variables, functions, '=', '+', '-', '*', '/', '//', '%', '^', '**', '(', ')', ',' and comments starting with '#'",
+	}
+}
+
+// returned by the parser if the token stream does not match the grammar
+type ParseError struct {
+	Token  Token   // token the parser stopped at
+	Code   string  // one of CODE_*
+	Msg    string  // description of what the parser expected
+	Note   string  // short description printed under the token, may be empty
+	Labels []Label // related locations, for instance an opening parenthesis
+	Hint   string  // may be empty
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parser: %s at %s", e.Msg, e.Token.Span.Start)
+}
+
+func (e *ParseError) Diagnostic() *Diagnostic {
+	return &Diagnostic{
+		Code:   e.Code,
+		Msg:    e.Msg,
+		Span:   e.Token.Span,
+		Note:   e.Note,
+		Labels: e.Labels,
+		Hint:   e.Hint,
+	}
+}
+
+// returned by the compiler if a node can not be transformed to bytecode
+type CompileError struct {
+	Span Span   // location of the node the compiler failed at
+	Code string // one of CODE_*
+	Msg  string // description of the failure
+	Hint string // may be empty
+	Err  error  // underlying error, may be nil
+}
+
+func (e *CompileError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("compile: %s at %s: %s", e.Msg, e.Span.Start, e.Err)
+	}
+	return fmt.Sprintf("compile: %s at %s", e.Msg, e.Span.Start)
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CompileError) Diagnostic() *Diagnostic {
+	msg := e.Msg
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %s", e.Msg, e.Err)
+	}
+	return &Diagnostic{Code: e.Code, Msg: msg, Span: e.Span, Hint: e.Hint}
+}
+
+// returned by the virtual machine if an operation can not be executed
+type RuntimeError struct {
+	Pos int       // index of the operation in the vm input
+	Op  Operation // operation the vm failed at
+	Msg string    // description of the failure
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("vm: %s at %d (%s %v)", e.Msg, e.Pos, OP_LOOKUP[e.Op.Code], e.Op.Arg)
+}
+
+func (e *RuntimeError) Diagnostic() *Diagnostic {
+	return &Diagnostic{
+		Code: CODE_RUNTIME,
+		Msg:  fmt.Sprintf("%s at %d (%s %v)", e.Msg, e.Pos, OP_LOOKUP[e.Op.Code], e.Op.Arg),
+	}
+}
+
+// multiple errors, returned by the parser if it encountered more than one
+// syntax error. Supports errors.As and errors.Is for the contained errors
+type ErrorList []error
+
+func (e ErrorList) Error() string {
+	b := strings.Builder{}
+	for i, err := range e {
+		if i > 0 {
+			b.WriteRune('\n')
+		}
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+func (e ErrorList) Unwrap() []error {
+	return e
+}
+
+// returned by the vm and the tree walk interpreter if calls of user defined
+// functions nest deeper than the default depth of MAX_CALL_DEPTH. Like the
+// *BudgetError of a configured call depth it matches ErrBudgetExceeded
+type StackOverflowError struct {
+	Function string // function whose call exceeded the depth
+	Depth    int    // allowed depth
+}
+
+func (e *StackOverflowError) Error() string {
+	return fmt.Sprintf("stack overflow: calling %s exceeded the maximum call depth of %d", e.Function, e.Depth)
+}
+
+func (e *StackOverflowError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+func (e *StackOverflowError) Diagnostic() *Diagnostic {
+	return &Diagnostic{
+		Code: CODE_STACK_OVERFLOW,
+		Msg:  fmt.Sprintf("calling %s exceeded the maximum call depth of %d", e.Function, e.Depth),
+		Hint: fmt.Sprintf("check %s for unbounded recursion", e.Function),
+	}
+}
+
+// resource of the vm limited by a budget
+type Budget string
+
+const (
+	BUDGET_INSTRUCTIONS Budget = "instructions"    // see Vm.MaxInstructions
+	BUDGET_CALL_DEPTH   Budget = "call depth"      // see Vm.MaxCallDepth and Interpreter.MaxCallDepth
+	BUDGET_NODES        Budget = "evaluated nodes" // see Interpreter.MaxNodes
+)
+
+// matches every *BudgetError and *StackOverflowError with errors.Is
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// returned by the vm and the tree walk interpreter if executing their input
+// exceeded a budget
+type BudgetError struct {
+	Budget Budget // exceeded resource
+	Limit  int    // configured limit
+	Pos    int    // index of the operation that exceeded the budget, -1 for the interpreter
+	Op     Operation
+	Span   Span // node that exceeded the budget, set by the interpreter
+}
+
+func (e *BudgetError) Error() string {
+	if e.Pos < 0 {
+		return fmt.Sprintf("eval: %s budget of %d exceeded at %s", e.Budget, e.Limit, e.Span.Start)
+	}
+	return fmt.Sprintf("vm: %s budget of %d exceeded at %d (%s %v)", e.Budget, e.Limit, e.Pos, OP_LOOKUP[e.Op.Code], e.Op.Arg)
+}
+
+func (e *BudgetError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+func (e *BudgetError) Diagnostic() *Diagnostic {
+	hint := "raise the limit with -max-instructions"
+	if e.Budget == BUDGET_CALL_DEPTH {
+		hint = "check for unbounded recursion or raise the limit with -max-call-depth"
+	}
+	if e.Pos < 0 {
+		return &Diagnostic{
+			Code: CODE_BUDGET,
+			Msg:  fmt.Sprintf("%s budget of %d exceeded", e.Budget, e.Limit),
+			Span: e.Span,
+			Hint: hint,
+		}
+	}
+	return &Diagnostic{
+		Code: CODE_BUDGET,
+		Msg:  fmt.Sprintf("%s budget of %d exceeded at %d (%s %v)", e.Budget, e.Limit, e.Pos, OP_LOOKUP[e.Op.Code], e.Op.Arg),
+		Hint: hint,
+	}
+}
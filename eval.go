@@ -1,9 +1,76 @@
 package main
 
-func Compile(n []Node) []Operation {
-	o := make([]Operation, 0)
+import "context"
+
+// Interpreter holds the state of a single tree walk: the parameters of the
+// function being evaluated and the depth of nested calls. Eval creates a new
+// Interpreter for each call, therefore multiple goroutines can evaluate at
+// the same time, even in the same Env.
+//
+// Like the Vm the interpreter can be limited: MaxNodes limits the amount of
+// evaluated nodes, the equivalent of Vm.MaxInstructions, MaxCallDepth the
+// nesting of calls and EvalContext stops once its context is done.
+type Interpreter struct {
+	env          *Env
+	scope        *scope // parameters of the function currently evaluated, nil at the top level
+	depth        int    // amount of nested calls
+	MaxNodes     int    // nodes evaluated before failing with a *BudgetError, 0 for no limit
+	MaxCallDepth int    // nested calls before failing with a *BudgetError, 0 for MAX_CALL_DEPTH and a *StackOverflowError, both match ErrBudgetExceeded
+	ctx          context.Context
+	evaluated    int // nodes evaluated by EvalContext
+}
+
+func NewInterpreter(env *Env) *Interpreter {
+	return &Interpreter{env: env}
+}
+
+// evaluates all nodes by walking the tree, variables are read from and written
+// to env, returns the value of the last node, mirroring the result the vm
+// leaves in register 0
+func Eval(env *Env, n []Node) (float64, error) {
+	results, err := EvalResults(env, n)
+	if err != nil || len(results) == 0 {
+		return 0, err
+	}
+	return results[len(results)-1], nil
+}
+
+// like Eval, returns the values of all nodes except function definitions,
+// mirroring the results the vm emits with OP_RESULT
+func EvalResults(env *Env, n []Node) ([]float64, error) {
+	return NewInterpreter(env).EvalContext(context.Background(), n)
+}
+
+// like EvalResults, stops with the error of ctx once it is done and with a
+// *BudgetError if a budget of the interpreter is exceeded
+func (in *Interpreter) EvalContext(ctx context.Context, n []Node) ([]float64, error) {
+	in.ctx, in.evaluated = ctx, 0
+	results := make([]float64, 0, len(n))
 	for _, node := range n {
-		o = append(o, node.Compile()...)
+		v, err := in.eval(node)
+		if err != nil {
+			return nil, err
+		}
+		// definitions have no result, like the vm emits no OP_RESULT
+		// for them
+		if _, ok := node.(*FuncDef); !ok {
+			results = append(results, v)
+		}
+	}
+	return results, nil
+}
+
+// evaluates the node, nodes evaluate their children through eval so the
+// budget and the context are checked for every node
+func (in *Interpreter) eval(n Node) (float64, error) {
+	in.evaluated++
+	if in.MaxNodes > 0 && in.evaluated > in.MaxNodes {
+		return 0, &BudgetError{Budget: BUDGET_NODES, Limit: in.MaxNodes, Pos: -1, Span: n.Span()}
+	}
+	if in.ctx != nil && in.evaluated%CANCEL_CHECK_INTERVAL == 0 {
+		if err := in.ctx.Err(); err != nil {
+			return 0, err
+		}
 	}
-	return o
+	return n.Eval(in)
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"math"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -156,6 +159,69 @@ func TestEval(t *testing.T) {
 			},
 			out: 66,
 		},
+		{
+			name: "2^3^2",
+			in: []Node{
+				&Binary{
+					token: Token{Type: TOKEN_CARET},
+					left:  &Number{token: Token{Raw: "2"}},
+					right: &Binary{
+						token: Token{Type: TOKEN_CARET},
+						left:  &Number{token: Token{Raw: "3"}},
+						right: &Number{token: Token{Raw: "2"}},
+					},
+				},
+			},
+			out: 512,
+		},
+		{
+			name: "-2^2",
+			in: []Node{
+				&Unary{
+					right: &Binary{
+						token: Token{Type: TOKEN_CARET},
+						left:  &Number{token: Token{Raw: "2"}},
+						right: &Number{token: Token{Raw: "2"}},
+					},
+				},
+			},
+			out: -4,
+		},
+		{
+			name: "2^-1",
+			in: []Node{
+				&Binary{
+					token: Token{Type: TOKEN_CARET},
+					left:  &Number{token: Token{Raw: "2"}},
+					right: &Unary{
+						right: &Number{token: Token{Raw: "1"}},
+					},
+				},
+			},
+			out: 0.5,
+		},
+		{
+			name: "-7%3",
+			in: []Node{
+				&Binary{
+					token: Token{Type: TOKEN_PERCENT},
+					left:  &Unary{right: &Number{token: Token{Raw: "7"}}},
+					right: &Number{token: Token{Raw: "3"}},
+				},
+			},
+			out: 2,
+		},
+		{
+			name: "7//-2",
+			in: []Node{
+				&Binary{
+					token: Token{Type: TOKEN_DOUBLE_SLASH},
+					left:  &Number{token: Token{Raw: "7"}},
+					right: &Unary{right: &Number{token: Token{Raw: "2"}}},
+				},
+			},
+			out: -4,
+		},
 		{
 			name: "readme example",
 			in: []Node{
@@ -173,11 +239,18 @@ func TestEval(t *testing.T) {
 		},
 	}
 
-	vm := Vm{trace: true}
+	vm := Vm{}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			vm.NewVmIn(Compile(test.in)).Execute()
+			ops, err := Compile(NewEnv(), test.in)
+			assert.NoError(t, err)
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
 			assert.Equal(t, test.out, vm.reg[0])
+
+			// the tree walk interpreter has to produce the same result
+			result, err := Eval(NewEnv(), test.in)
+			assert.NoError(t, err)
+			assert.Equal(t, test.out, result)
 		})
 	}
 }
@@ -188,20 +261,649 @@ func TestCompile(t *testing.T) {
 		Out []Operation
 	}{
 		{In: "2+1*1", Out: []Operation{
+			{OP_LOAD, 1},
+			{OP_STORE, 1},
+			{OP_LOAD, 1},
+			{OP_MULTIPY, 1},
+			{OP_STORE, 1},
+			{OP_LOAD, 2},
+			{OP_ADD, 1},
+			{OP_RESULT, 0},
+		}},
+		{In: "2*1+1", Out: []Operation{
 			{OP_LOAD, 2},
 			{OP_STORE, 1},
 			{OP_LOAD, 1},
-			{OP_STORE, 2},
+			{OP_MULTIPY, 1},
+			{OP_STORE, 1},
+			{OP_LOAD, 1},
+			{OP_ADD, 1},
+			{OP_RESULT, 0},
+		}},
+		{In: "2-3*4", Out: []Operation{
+			{OP_LOAD, 3},
+			{OP_STORE, 1},
+			{OP_LOAD, 4},
+			{OP_MULTIPY, 1},
+			{OP_STORE, 1},
+			{OP_LOAD, 2},
+			{OP_RSUBTRACT, 1},
+			{OP_RESULT, 0},
+		}},
+		{In: "(1+2)/(3+4)", Out: []Operation{
 			{OP_LOAD, 1},
-			{OP_MULTIPY, 2},
+			{OP_STORE, 1},
+			{OP_LOAD, 2},
 			{OP_ADD, 1},
+			{OP_STORE, 1},
+			{OP_LOAD, 3},
+			{OP_STORE, 2},
+			{OP_LOAD, 4},
+			{OP_ADD, 2},
+			{OP_DIVIDE, 1},
+			{OP_RESULT, 0},
 		}},
 	}
 	for _, test := range tests {
 		t.Run(test.In, func(t *testing.T) {
-			token := NewLexer(strings.NewReader(test.In)).Lex()
-			ast := NewParser(token).Parse()
-			assert.EqualValues(t, test.Out, Compile(ast))
+			token, err := NewLexer(strings.NewReader(test.In)).Lex()
+			assert.NoError(t, err)
+			ast, err := NewParser(token).Parse()
+			assert.NoError(t, err)
+			ops, err := Compile(NewEnv(), ast)
+			assert.NoError(t, err)
+			assert.EqualValues(t, test.Out, ops)
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{name: "malformed number", in: "1.2.3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := NewLexer(strings.NewReader(test.in)).Lex()
+			assert.NoError(t, err)
+			ast, err := NewParser(token).Parse()
+			assert.NoError(t, err)
+			_, err = Compile(NewEnv(), ast)
+			var compileErr *CompileError
+			assert.ErrorAs(t, err, &compileErr)
+		})
+	}
+}
+
+// lexes and parses in, fails the test on error
+func parse(t *testing.T, in string) []Node {
+	t.Helper()
+	token, err := NewLexer(strings.NewReader(in)).Lex()
+	assert.NoError(t, err)
+	ast, err := NewParser(token).Parse()
+	assert.NoError(t, err)
+	return ast
+}
+
+func TestVariables(t *testing.T) {
+	// every input is executed separately, variables persist in the
+	// environment between the calls
+	in := []struct {
+		in  string
+		out float64
+	}{
+		{in: "x = 3 * 4", out: 12},
+		{in: "y = x + 1", out: 13},
+		{in: "x = y * 2", out: 26},
+		{in: "x - y\nx_2 = x / 2\nx_2", out: 13},
+	}
+
+	vmEnv := NewEnv()
+	vm := Vm{env: vmEnv}
+	treeEnv := NewEnv()
+	for _, test := range in {
+		t.Run(test.in, func(t *testing.T) {
+			ast := parse(t, test.in)
+			ops, err := Compile(vmEnv, ast)
+			assert.NoError(t, err)
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			assert.Equal(t, test.out, vm.reg[0])
+
+			result, err := Eval(treeEnv, ast)
+			assert.NoError(t, err)
+			assert.Equal(t, test.out, result)
+		})
+	}
+
+	for _, env := range []*Env{vmEnv, treeEnv} {
+		x, ok := env.Get("x")
+		assert.True(t, ok)
+		assert.Equal(t, 26.0, x)
+	}
+}
+
+func TestUndefinedVariable(t *testing.T) {
+	for _, in := range []string{"a + 1", "a = a + 1", "b\nb = 1"} {
+		t.Run(in, func(t *testing.T) {
+			ast := parse(t, in)
+			var compileErr *CompileError
+
+			_, err := Compile(NewEnv(), ast)
+			if assert.ErrorAs(t, err, &compileErr) {
+				assert.Equal(t, CODE_UNDEFINED_VARIABLE, compileErr.Code)
+			}
+
+			_, err = Eval(NewEnv(), ast)
+			if assert.ErrorAs(t, err, &compileErr) {
+				assert.Equal(t, CODE_UNDEFINED_VARIABLE, compileErr.Code)
+			}
+		})
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	tests := []struct {
+		in  string
+		out float64
+	}{
+		{in: "sqrt(16)", out: 4},
+		{in: "abs(-2) + 1", out: 3},
+		{in: "max(1, 5, 3)", out: 5},
+		{in: "min(4)", out: 4},
+		{in: "max(1, min(2, 3)) * 2", out: 4},
+		{in: "log(8, 2)", out: 3},
+		{in: "log(exp(2))", out: 2},
+		{in: "hypot(3, 4)", out: 5},
+		{in: "floor(-1.5) + ceil(1.2)", out: 0},
+		{in: "x = 9\nsqrt(x) ^ 2", out: 9},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			ast := parse(t, test.in)
+			vm := Vm{env: NewEnv()}
+			ops, err := Compile(vm.env, ast)
+			assert.NoError(t, err)
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			assert.Equal(t, test.out, vm.reg[0])
+			assert.Empty(t, vm.stack)
+
+			result, err := Eval(NewEnv(), ast)
+			assert.NoError(t, err)
+			assert.Equal(t, test.out, result)
+		})
+	}
+}
+
+func TestBuiltinErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		code string
+	}{
+		{in: "sqrt()", code: CODE_ARITY},
+		{in: "sqrt(1, 2)", code: CODE_ARITY},
+		{in: "max()", code: CODE_ARITY},
+		{in: "atan2(1)", code: CODE_ARITY},
+		{in: "foo(1)", code: CODE_UNKNOWN_FUNCTION},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			ast := parse(t, test.in)
+			var compileErr *CompileError
+
+			_, err := Compile(NewEnv(), ast)
+			if assert.ErrorAs(t, err, &compileErr) {
+				assert.Equal(t, test.code, compileErr.Code)
+			}
+
+			_, err = Eval(NewEnv(), ast)
+			if assert.ErrorAs(t, err, &compileErr) {
+				assert.Equal(t, test.code, compileErr.Code)
+			}
+		})
+	}
+}
+
+func TestConstants(t *testing.T) {
+	tests := []struct {
+		in  string
+		out float64
+	}{
+		{in: "pi", out: math.Pi},
+		{in: "r = 2\n2*pi*r", out: 4 * math.Pi},
+		{in: "tau / 2", out: math.Pi},
+		{in: "log(e)", out: 1},
+		{in: "phi", out: math.Phi},
+		{in: "-inf", out: math.Inf(-1)},
+		{in: "answer * 2", out: 84},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			ast := parse(t, test.in)
+			vm := Vm{env: NewEnv()}
+			assert.NoError(t, vm.env.DefineConst("answer", 42))
+			ops, err := Compile(vm.env, ast)
+			assert.NoError(t, err)
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			assert.Equal(t, test.out, vm.reg[0])
+
+			env := NewEnv()
+			assert.NoError(t, env.DefineConst("answer", 42))
+			result, err := Eval(env, ast)
+			assert.NoError(t, err)
+			assert.Equal(t, test.out, result)
+		})
+	}
+
+	t.Run("folded into OP_LOAD", func(t *testing.T) {
+		ops, err := Compile(NewEnv(), parse(t, "pi"))
+		assert.NoError(t, err)
+		assert.Equal(t, []Operation{{OP_LOAD, math.Pi}, {OP_RESULT, 0}}, ops)
+	})
+
+	t.Run("nan", func(t *testing.T) {
+		result, err := Eval(NewEnv(), parse(t, "nan"))
+		assert.NoError(t, err)
+		assert.True(t, math.IsNaN(result))
+	})
+}
+
+func TestConstantAssignment(t *testing.T) {
+	ast := parse(t, "pi = 3")
+	var compileErr *CompileError
+
+	_, err := Compile(NewEnv(), ast)
+	if assert.ErrorAs(t, err, &compileErr) {
+		assert.Equal(t, CODE_CONSTANT_ASSIGNMENT, compileErr.Code)
+	}
+
+	_, err = Eval(NewEnv(), ast)
+	if assert.ErrorAs(t, err, &compileErr) {
+		assert.Equal(t, CODE_CONSTANT_ASSIGNMENT, compileErr.Code)
+	}
+
+	env := NewEnv()
+	assert.Error(t, env.Set("e", 1))
+	assert.Error(t, env.DefineConst("pi", 3))
+	assert.NoError(t, env.Set("x", 1))
+	assert.Error(t, env.DefineConst("x", 1))
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  float64
+	}{
+		{name: "call", in: "f(x, y) = x^2 + y\nf(3, 1)", out: 10},
+		{name: "nested calls", in: "sq(x) = x * x\nsum(a, b) = sq(a) + sq(b)\nsum(3, sq(2))", out: 25},
+		{name: "parameter shadows variable", in: "x = 10\nf(x) = x + 1\nf(1) + x", out: 12},
+		{name: "global assigned after definition", in: "f(x) = x * k\nk = 3\nf(2)", out: 6},
+		{name: "registers of the caller are kept", in: "f(x) = (x + 1) * (x + 2)\n1 + 2 * (3 + f(1))", out: 19},
+		{name: "builtins in body", in: "len(x, y) = sqrt(x^2 + y^2)\nmax(len(3, 4), 1)", out: 5},
+		{name: "arguments evaluated in caller", in: "f(x) = x\ng(x) = f(x + 1) * 2\ng(1)", out: 4},
+		{name: "redefinition", in: "f(x) = x\nf(x) = 2 * x\nf(3)", out: 6},
+		{name: "definition keeps the result", in: "5\nf(x) = x", out: 5},
+		{name: "no parameters", in: "answer() = 42\nanswer()", out: 42},
+		{name: "call of function defined later", in: "f(x) = g(x) + 1\ng(x) = x * 2\nf(3)", out: 7},
+		{name: "mutual recursion", in: "even(n) = n * odd(n - 1)\nodd(n) = 1 + 0 * n\neven(4)", out: 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ast := parse(t, test.in)
+			vm := Vm{env: NewEnv()}
+			ops, err := Compile(vm.env, ast)
+			assert.NoError(t, err)
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			assert.Equal(t, test.out, vm.reg[0])
+			assert.Empty(t, vm.frames)
+			assert.Empty(t, vm.stack)
+
+			result, err := Eval(NewEnv(), ast)
+			assert.NoError(t, err)
+			assert.Equal(t, test.out, result)
+		})
+	}
+}
+
+func TestFunctionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		code string
+	}{
+		{name: "wrong number of arguments", in: "f(x) = x\nf(1, 2)", code: CODE_ARITY},
+		{name: "call before definition", in: "f(1)\nf(x) = x", code: CODE_UNKNOWN_FUNCTION},
+		{name: "redefine builtin", in: "sqrt(x) = x", code: CODE_BUILTIN_REDEFINITION},
+		{name: "constant as parameter", in: "f(pi) = pi", code: CODE_CONSTANT_ASSIGNMENT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ast := parse(t, test.in)
+			var compileErr *CompileError
+
+			_, err := Compile(NewEnv(), ast)
+			if assert.ErrorAs(t, err, &compileErr) {
+				assert.Equal(t, test.code, compileErr.Code)
+			}
+
+			_, err = Eval(NewEnv(), ast)
+			if assert.ErrorAs(t, err, &compileErr) {
+				assert.Equal(t, test.code, compileErr.Code)
+			}
+		})
+	}
+
+	t.Run("failed definition is discarded", func(t *testing.T) {
+		env := NewEnv()
+		_, err := Compile(env, parse(t, "f(x) = x\nf(x) = sqrt(x, x)"))
+		assert.Error(t, err)
+		_, err = Compile(env, parse(t, "g(x) = sqrt(x, x)"))
+		assert.Error(t, err)
+		_, ok := env.lookupFunc("g")
+		assert.False(t, ok)
+		slot, ok := env.lookupFunc("f")
+		assert.True(t, ok)
+		assert.NotNil(t, env.function(slot).Code)
+	})
+
+	t.Run("function defined later is checked once called", func(t *testing.T) {
+		env := NewEnv()
+		code, err := Compile(env, parse(t, "f(x) = g(x) + 1\nf(1)"))
+		assert.NoError(t, err)
+		vm := Vm{env: env}
+		var runtimeErr *RuntimeError
+		if assert.ErrorAs(t, vm.NewVmIn(code).Execute(), &runtimeErr) {
+			assert.Equal(t, `unknown function "g"`, runtimeErr.Msg)
+		}
+
+		// a failed definition keeps the slot f calls
+		_, err = Compile(env, parse(t, "g(x) = sqrt(x, x)"))
+		assert.Error(t, err)
+		code, err = Compile(env, parse(t, "g(x) = x * 2\nf(3)"))
+		assert.NoError(t, err)
+		assert.NoError(t, vm.NewVmIn(code).Execute())
+		assert.Equal(t, float64(7), vm.Results()[0])
+
+		var compileErr *CompileError
+		_, err = Eval(NewEnv(), parse(t, "f(x) = g(x) + 1\nf(1)"))
+		if assert.ErrorAs(t, err, &compileErr) {
+			assert.Equal(t, CODE_UNKNOWN_FUNCTION, compileErr.Code)
+		}
+	})
+
+	t.Run("unbounded recursion", func(t *testing.T) {
+		ast := parse(t, "f(x) = f(x + 1)\nf(0)")
+		var overflow *StackOverflowError
+
+		vm := Vm{env: NewEnv()}
+		ops, err := Compile(vm.env, ast)
+		assert.NoError(t, err)
+		if assert.ErrorAs(t, vm.NewVmIn(ops).Execute(), &overflow) {
+			assert.Equal(t, "f", overflow.Function)
+		}
+
+		_, err = Eval(NewEnv(), ast)
+		if assert.ErrorAs(t, err, &overflow) {
+			assert.Equal(t, "f", overflow.Function)
+		}
+	})
+}
+
+// fully balanced tree of op with 2^depth leaves, needs depth registers
+func balanced(op string, leaf string, depth int) string {
+	if depth == 0 {
+		return leaf
+	}
+	sub := balanced(op, leaf, depth-1)
+	return "(" + sub + op + sub + ")"
+}
+
+func TestSpilling(t *testing.T) {
+	// the allocator hands out SPILL_REGISTER-1 registers, a balanced tree
+	// of depth SPILL_REGISTER needs one more
+	depth := SPILL_REGISTER
+	tests := []struct {
+		name string
+		in   string
+		out  float64
+	}{
+		{name: "balanced", in: balanced("+", "1", depth), out: math.Pow(2, float64(depth))},
+		{name: "balanced non commutative", in: balanced("-", "1", depth), out: 0},
+		{name: "spilled in function", in: "f(x) = " + balanced("*", "x", depth) + "\nf(1) + f(1)", out: 2},
+		{name: "spilled call arguments", in: balanced("+", "max(1, 2+(3))", depth), out: 5 * math.Pow(2, float64(depth))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ast := parse(t, test.in)
+			vm := Vm{env: NewEnv()}
+			ops, err := Compile(vm.env, ast)
+			assert.NoError(t, err)
+			all := ops
+			for _, f := range vm.env.funcs {
+				all = append(all, f.Code...)
+			}
+			assert.Contains(t, all, Operation{OP_POP, float64(SPILL_REGISTER)})
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			assert.Equal(t, test.out, vm.reg[0])
+			assert.Empty(t, vm.stack)
+
+			result, err := Eval(NewEnv(), ast)
+			assert.NoError(t, err)
+			assert.Equal(t, test.out, result)
+		})
+	}
+}
+
+// highest register the operations store a value in
+func maxRegister(ops []Operation) int {
+	max := 0
+	for _, op := range ops {
+		if op.Code == OP_STORE && int(op.Arg) > max {
+			max = int(op.Arg)
+		}
+	}
+	return max
+}
+
+func TestRegisterAllocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		registers int
+	}{
+		{name: "leaf", in: "1", registers: 0},
+		{name: "left nested", in: strings.Repeat("(", 100) + "1" + strings.Repeat("+1)", 100), registers: 1},
+		{name: "right nested", in: strings.Repeat("1+(", 100) + "1" + strings.Repeat(")", 100), registers: 1},
+		{name: "right nested non commutative", in: strings.Repeat("2-(", 100) + "1" + strings.Repeat(")", 100), registers: 1},
+		{name: "right nested power", in: strings.Repeat("1^", 100) + "1", registers: 1},
+		{name: "balanced", in: balanced("/", "2", 4), registers: 4},
+		{name: "heavier right", in: "1-" + balanced("*", "2", 3), registers: 3},
+		{name: "call arguments", in: "max(" + balanced("+", "1", 2) + ", " + balanced("+", "1", 3) + ")", registers: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ast := parse(t, test.in)
+			vm := Vm{env: NewEnv()}
+			ops, err := Compile(vm.env, ast)
+			assert.NoError(t, err)
+			assert.Equal(t, test.registers, maxRegister(ops))
+			assert.NotContains(t, ops, Operation{OP_POP, float64(SPILL_REGISTER)})
+
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			result, err := Eval(NewEnv(), ast)
+			assert.NoError(t, err)
+			assert.True(t, sameFloat(result, vm.reg[0]), "vm: %v, tree: %v", vm.reg[0], result)
+		})
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string // number or input parsing to the expected optimized tree
+	}{
+		{in: "1+2*3", out: "7"},
+		{in: "-(2^3)", out: "-8"},
+		{in: "7 // 2 + 7 % 2", out: "4"},
+		{in: "2*pi", out: "6.283185307179586"},
+		{in: "sqrt(16) + max(1, 2, 3)", out: "7"},
+		{in: "1/0", out: "+Inf"},
+		{in: "x*1", out: "x"},
+		{in: "1*x", out: "x"},
+		{in: "x/1", out: "x"},
+		{in: "x^1", out: "x"},
+		{in: "x+0", out: "x"},
+		{in: "0+x", out: "x"},
+		{in: "x-0", out: "x"},
+		{in: "--x", out: "x"},
+		{in: "---x", out: "-x"},
+		{in: "x*(3-2)", out: "x"},
+		{in: "x + 2*3", out: "x + 6"},
+		{in: "sqrt(x*1)", out: "sqrt(x)"},
+		{in: "y = x * (1+1)", out: "y = x * 2"},
+		{in: "f(pi) = pi * 1 + e", out: "f(pi) = pi + 2.718281828459045"},
+		// identities dropping x do not hold for NaN and infinity
+		{in: "x*0", out: "x*0"},
+		{in: "0-x", out: "0-x"},
+		{in: "x^0", out: "x^0"},
+		// errors are left for the compiler
+		{in: "1.2.3 + 1", out: "1.2.3 + 1"},
+		{in: "sqrt(1, 2)", out: "sqrt(1, 2)"},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			env := NewEnv()
+			assert.NoError(t, env.Set("x", 3))
+			ast := parse(t, test.in)
+			before := ast[0].String(0)
+			optimized := Optimize(env, ast)
+			want := (&Number{token: Token{Raw: test.out}}).String(0)
+			if _, err := strconv.ParseFloat(test.out, 64); err != nil {
+				want = parse(t, test.out)[0].String(0)
+			}
+			assert.Equal(t, want, optimized[0].String(0))
+			assert.Equal(t, before, ast[0].String(0), "the input tree is modified")
+		})
+	}
+}
+
+func TestOptimizeResult(t *testing.T) {
+	tests := []string{
+		"1+2*3-4/5",
+		"x*1 + 0 - --x",
+		"(x+0)^1 // (1*2) % 3",
+		"-(-(-x))",
+		"max(x*1, 2^3, sqrt(pi))",
+		"f(x) = x*1 + e*1\nf(x+0) + f(2)",
+	}
+	for _, in := range tests {
+		t.Run(in, func(t *testing.T) {
+			ast := parse(t, in)
+			results := make([]float64, 0, 4)
+			for _, optimize := range []bool{false, true} {
+				nodes := ast
+				env := NewEnv()
+				assert.NoError(t, env.Set("x", 3))
+				if optimize {
+					nodes = Optimize(env, ast)
+				}
+				vm := Vm{env: env}
+				ops, err := Compile(env, nodes)
+				assert.NoError(t, err)
+				assert.NoError(t, vm.NewVmIn(ops).Execute())
+				results = append(results, vm.reg[0])
+
+				treeEnv := NewEnv()
+				assert.NoError(t, treeEnv.Set("x", 3))
+				result, err := Eval(treeEnv, nodes)
+				assert.NoError(t, err)
+				results = append(results, result)
+			}
+			for _, result := range results[1:] {
+				assert.Equal(t, results[0], result)
+			}
+		})
+	}
+}
+
+func TestResults(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp []float64
+	}{
+		{in: "1+1\n2*3", exp: []float64{2, 6}},
+		{in: "x = 2\nx * 3\nx", exp: []float64{2, 6, 2}},
+		{in: "f(x) = x + 1", exp: []float64{}},
+		{in: "f(x) = x + 1\nf(1)\ng(y) = f(y) * 2\ng(2)", exp: []float64{2, 6}},
+		{in: "max(1, 2)\nabs(-3)", exp: []float64{2, 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			for _, peephole := range []bool{false, true} {
+				env := NewEnv()
+				compiler := NewCompiler(env)
+				compiler.Peephole = peephole
+				code, err := compiler.Compile(parse(t, test.in))
+				assert.NoError(t, err)
+
+				emitted := make([]float64, 0)
+				vm := Vm{env: env, Emit: func(v float64) { emitted = append(emitted, v) }}
+				assert.NoError(t, vm.NewVmIn(code).Execute())
+				assert.Equal(t, test.exp, emitted)
+				assert.Equal(t, test.exp, append([]float64{}, vm.Results()...))
+			}
+
+			results, err := EvalResults(NewEnv(), parse(t, test.in))
+			assert.NoError(t, err)
+			assert.Equal(t, test.exp, results)
 		})
 	}
 }
+
+// chain of n functions each calling the previous one twice, calling the last
+// evaluates 2^n calls
+func callChain(n int) string {
+	b := strings.Builder{}
+	b.WriteString("f0(x) = x\n")
+	for i := 1; i < n; i++ {
+		fmt.Fprintf(&b, "f%d(x) = f%d(x) + f%d(x)\n", i, i-1, i-1)
+	}
+	fmt.Fprintf(&b, "f%d(1)", n-1)
+	return b.String()
+}
+
+func TestInterpreterBudgets(t *testing.T) {
+	in := NewInterpreter(NewEnv())
+	in.MaxNodes = 3
+	results, err := in.EvalContext(context.Background(), parse(t, "1+2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{3}, results)
+
+	in.MaxNodes = 2
+	_, err = in.EvalContext(context.Background(), parse(t, "1+2"))
+	var budgetErr *BudgetError
+	if assert.ErrorAs(t, err, &budgetErr) {
+		assert.Equal(t, BudgetError{Budget: BUDGET_NODES, Limit: 2, Pos: -1, Span: span(1, 3, 2, 3)}, *budgetErr)
+	}
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+
+	in = NewInterpreter(NewEnv())
+	in.MaxCallDepth = 10
+	_, err = in.EvalContext(context.Background(), parse(t, "f(x) = f(x)\nf(1)"))
+	if assert.ErrorAs(t, err, &budgetErr) {
+		assert.Equal(t, BUDGET_CALL_DEPTH, budgetErr.Budget)
+	}
+	in.MaxCallDepth = 0
+	var overflow *StackOverflowError
+	_, err = in.EvalContext(context.Background(), parse(t, "f(1)"))
+	assert.ErrorAs(t, err, &overflow)
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewInterpreter(NewEnv()).EvalContext(ctx, parse(t, callChain(40)))
+	assert.ErrorIs(t, err, context.Canceled)
+}
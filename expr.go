@@ -1,87 +1,260 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"math"
 	"strconv"
 	"strings"
 )
 
-type RegisterAllocator struct {
-	registers [REGISTER_COUNT]bool
+type Node interface {
+	Compile(comp *Compiler) ([]Operation, error)
+	Eval(in *Interpreter) (float64, error) // computes the value of the node by walking the tree
+	Optimize(o *Optimizer) Node            // returns the node with constant subtrees folded and identities applied, does not modify the node
+	String(ident int) string
+	Span() Span // location of the nodes source text in the input
 }
 
-func (r *RegisterAllocator) alloc() float64 {
-	for i, v := range r.registers {
-		if v == false {
-			r.registers[i] = true
-			return float64(i + 1)
-		}
-	}
-	panic("Out of bounds, no more free registers")
+// Optimizer folds constant subtrees and applies algebraic identities that
+// keep the result of an expression unchanged, see Optimize
+type Optimizer struct {
+	env   *Env
+	scope map[string]bool // parameters of the function body being optimized, they shadow constants
 }
 
-func (r *RegisterAllocator) dealloc(index float64) {
-	i := int(index)
-	if r.registers[i-1] {
-		r.registers[i-1] = false
-	} else {
-		panic("Register not previously occupied")
+// returns the optimized version of all nodes, constants are read from env.
+// The nodes are not modified, the result shares unchanged subtrees with them.
+//
+// Subtrees only consisting of numbers, constants and builtin calls are
+// replaced by their value, invalid numbers and calls with the wrong amount of
+// arguments are left for the compiler to report. The identities
+//
+//	x * 1 = 1 * x = x
+//	x / 1 = x
+//	x ^ 1 = x
+//	x + 0 = 0 + x = x
+//	x - 0 = x
+//	--x = x
+//
+// hold for every x, except x + 0 for x = -0, which results in 0 instead of -0.
+// Identities that drop x, such as x * 0 = 0, are not applied, they do not hold
+// for NaN and infinity and would hide errors computing x
+func Optimize(env *Env, n []Node) []Node {
+	o := &Optimizer{env: env}
+	optimized := make([]Node, len(n))
+	for i, node := range n {
+		optimized[i] = node.Optimize(o)
 	}
+	return optimized
 }
 
-var Allocator RegisterAllocator
+// number node with the value v, located at span
+func folded(v float64, span Span) *Number {
+	return &Number{token: Token{
+		Type: TOKEN_NUMBER,
+		Raw:  strconv.FormatFloat(v, 'g', -1, 64),
+		Span: span,
+	}}
+}
 
-type Node interface {
-	Compile() []Operation
-	String(ident int) string
+// returns the value of n if it is a valid number
+func constant(n Node) (float64, bool) {
+	number, ok := n.(*Number)
+	if !ok {
+		return 0, false
+	}
+	val, err := number.value()
+	return val, err == nil
 }
 
 type Number struct {
 	token Token
 }
 
-func (n *Number) Compile() []Operation {
+// parses the raw token to a float
+func (n *Number) value() (float64, error) {
 	val, err := strconv.ParseFloat(n.token.Raw, 64)
 	if err != nil {
-		log.Panicf("compile: failed to parse float: %q", err)
+		return 0, &CompileError{
+			Span: n.Span(),
+			Code: CODE_INVALID_NUMBER,
+			Msg:  fmt.Sprintf("invalid number %q", n.token.Raw),
+			Hint: "numbers consist of digits, a single '.', '_' as separator and 'e' for the exponent",
+			Err:  err,
+		}
 	}
-	return []Operation{{OP_LOAD, val}}
+	return val, nil
+}
+
+func (n *Number) Compile(comp *Compiler) ([]Operation, error) {
+	val, err := n.value()
+	if err != nil {
+		return nil, err
+	}
+	return comp.emit(n.Span(), Operation{OP_LOAD, val}), nil
+}
+
+func (n *Number) Eval(in *Interpreter) (float64, error) {
+	return n.value()
+}
+
+func (n *Number) Optimize(o *Optimizer) Node {
+	return n
 }
 
 func (n *Number) String(ident int) string {
 	return fmt.Sprint(strings.Repeat(" ", ident), n.token.Raw)
 }
 
+func (n *Number) Span() Span {
+	return n.token.Span
+}
+
 type Binary struct {
 	token Token
 	left  Node
 	right Node
+	span  Span
+}
+
+// the operand needing more registers is computed first and kept in a
+// register while computing the other operand (Sethi–Ullman), if all
+// registers are in use it is spilled to the stack and popped into
+// SPILL_REGISTER once the other operand is computed. Computing the right
+// operand first swaps the operands, non commutative operations use their
+// reversed operation
+func (b *Binary) Compile(comp *Compiler) ([]Operation, error) {
+	operation, reversed := OP_NOP, OP_NOP
+	switch b.token.Type {
+	case TOKEN_PLUS:
+		operation, reversed = OP_ADD, OP_ADD
+	case TOKEN_MINUS:
+		operation, reversed = OP_SUBTRACT, OP_RSUBTRACT
+	case TOKEN_SLASH:
+		operation, reversed = OP_DIVIDE, OP_RDIVIDE
+	case TOKEN_ASTERISK:
+		operation, reversed = OP_MULTIPY, OP_MULTIPY
+	case TOKEN_DOUBLE_SLASH:
+		operation, reversed = OP_FLOOR_DIVIDE, OP_RFLOOR_DIVIDE
+	case TOKEN_PERCENT:
+		operation, reversed = OP_MODULO, OP_RMODULO
+	case TOKEN_CARET:
+		operation, reversed = OP_POW, OP_RPOW
+	default:
+		return nil, b.unknownOperator()
+	}
+
+	first, second := b.left, b.right
+	if comp.need(b.right) > comp.need(b.left) {
+		first, second = b.right, b.left
+		operation = reversed
+	}
+
+	codes, err := first.Compile(comp)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := comp.alloc.alloc()
+	if ok {
+		defer comp.alloc.dealloc(i)
+		codes = append(codes, comp.emit(b.span, Operation{OP_STORE, i})...)
+	} else {
+		codes = append(codes, comp.emit(b.span, Operation{Code: OP_PUSH})...)
+	}
+	secondCodes, err := second.Compile(comp)
+	if err != nil {
+		return nil, err
+	}
+	codes = append(codes, secondCodes...)
+	if !ok {
+		i = float64(SPILL_REGISTER)
+		codes = append(codes, comp.emit(b.span, Operation{OP_POP, i})...)
+	}
+
+	codes = append(codes, comp.emit(b.span, Operation{operation, i})...)
+	return codes, nil
 }
 
-func (b *Binary) Compile() []Operation {
-	codes := b.left.Compile()
-	i := Allocator.alloc()
-	defer Allocator.dealloc(i)
-	codes = append(codes, Operation{OP_STORE, i})
-	codes = append(codes, b.right.Compile()...)
+func (b *Binary) Eval(in *Interpreter) (float64, error) {
+	left, err := in.eval(b.left)
+	if err != nil {
+		return 0, err
+	}
+	right, err := in.eval(b.right)
+	if err != nil {
+		return 0, err
+	}
+	return b.apply(left, right)
+}
 
-	operation := OP_NOP
+// computes the result of the operator for the values of both operands
+func (b *Binary) apply(left, right float64) (float64, error) {
 	switch b.token.Type {
 	case TOKEN_PLUS:
-		operation = OP_ADD
+		return left + right, nil
 	case TOKEN_MINUS:
-		operation = OP_SUBTRACT
+		return left - right, nil
 	case TOKEN_SLASH:
-		operation = OP_DIVIDE
+		return left / right, nil
 	case TOKEN_ASTERISK:
-		operation = OP_MULTIPY
+		return left * right, nil
+	case TOKEN_DOUBLE_SLASH:
+		return floorDiv(left, right), nil
+	case TOKEN_PERCENT:
+		return floorMod(left, right), nil
+	case TOKEN_CARET:
+		return math.Pow(left, right), nil
 	default:
-		panic("Unknown type")
+		return 0, b.unknownOperator()
+	}
+}
+
+func (b *Binary) Optimize(o *Optimizer) Node {
+	left, right := b.left.Optimize(o), b.right.Optimize(o)
+	l, lConst := constant(left)
+	r, rConst := constant(right)
+	if lConst && rConst {
+		if val, err := b.apply(l, r); err == nil {
+			return folded(val, b.span)
+		}
+	}
+
+	switch b.token.Type {
+	case TOKEN_ASTERISK:
+		if rConst && r == 1 {
+			return left
+		} else if lConst && l == 1 {
+			return right
+		}
+	case TOKEN_SLASH, TOKEN_CARET:
+		if rConst && r == 1 {
+			return left
+		}
+	case TOKEN_PLUS:
+		if rConst && r == 0 {
+			return left
+		} else if lConst && l == 0 {
+			return right
+		}
+	case TOKEN_MINUS:
+		if rConst && r == 0 {
+			return left
+		}
+	}
+
+	if left == b.left && right == b.right {
+		return b
 	}
+	return &Binary{token: b.token, left: left, right: right, span: b.span}
+}
 
-	codes = append(codes, Operation{operation, i})
-	return codes
+func (b *Binary) unknownOperator() error {
+	return &CompileError{
+		Span: b.token.Span,
+		Code: CODE_INTERNAL,
+		Msg:  fmt.Sprintf("unknown binary operator %q", b.token.Raw),
+	}
 }
 
 func (b *Binary) String(ident int) string {
@@ -89,18 +262,433 @@ func (b *Binary) String(ident int) string {
 	return fmt.Sprint(identStr, b.token.Raw, "\n ", identStr, b.left.String(ident+1), "\n ", identStr, b.right.String(ident+1))
 }
 
+func (b *Binary) Span() Span {
+	return b.span
+}
+
 type Unary struct {
 	token Token
 	right Node
+	span  Span
+}
+
+func (u *Unary) Compile(comp *Compiler) ([]Operation, error) {
+	codes, err := u.right.Compile(comp)
+	if err != nil {
+		return nil, err
+	}
+	codes = append(codes, comp.emit(u.span, Operation{Code: OP_NEG})...)
+	return codes, nil
 }
 
-func (u *Unary) Compile() []Operation {
-	codes := u.right.Compile()
-	codes = append(codes, Operation{Code: OP_NEG})
-	return codes
+func (u *Unary) Eval(in *Interpreter) (float64, error) {
+	right, err := in.eval(u.right)
+	if err != nil {
+		return 0, err
+	}
+	return -right, nil
+}
+
+func (u *Unary) Optimize(o *Optimizer) Node {
+	right := u.right.Optimize(o)
+	if val, ok := constant(right); ok {
+		return folded(-val, u.span)
+	}
+	if inner, ok := right.(*Unary); ok {
+		return inner.right
+	}
+	if right == u.right {
+		return u
+	}
+	return &Unary{token: u.token, right: right, span: u.span}
 }
 
 func (u *Unary) String(ident int) string {
 	identStr := strings.Repeat(" ", ident)
 	return fmt.Sprint(identStr, "/\n ", identStr, "-", u.right.String(ident+1))
 }
+
+func (u *Unary) Span() Span {
+	return u.span
+}
+
+type Ident struct {
+	token Token
+}
+
+// error for variables that were never assigned
+func (i *Ident) undefined() error {
+	return &CompileError{
+		Span: i.Span(),
+		Code: CODE_UNDEFINED_VARIABLE,
+		Msg:  fmt.Sprintf("undefined variable %q", i.token.Raw),
+		Hint: fmt.Sprintf("assign a value before using it, e.g. '%s = 1'", i.token.Raw),
+	}
+}
+
+// parameters of the function body being compiled shadow constants and
+// variables, constants are replaced with their value
+func (i *Ident) Compile(comp *Compiler) ([]Operation, error) {
+	if comp.scope != nil {
+		if slot, ok := comp.scope.params[i.token.Raw]; ok {
+			return comp.emit(i.Span(), Operation{OP_LOAD_LOCAL, float64(slot)}), nil
+		}
+	}
+	if value, ok := comp.env.Const(i.token.Raw); ok {
+		return comp.emit(i.Span(), Operation{OP_LOAD, value}), nil
+	}
+	slot, ok := comp.env.lookup(i.token.Raw)
+	if !ok {
+		// function bodies may reference variables assigned after the
+		// definition, the vm checks if they are assigned once called
+		if comp.scope == nil {
+			return nil, i.undefined()
+		}
+		slot = comp.env.declare(i.token.Raw)
+	}
+	return comp.emit(i.Span(), Operation{OP_LOAD_GLOBAL, float64(slot)}), nil
+}
+
+func (i *Ident) Eval(in *Interpreter) (float64, error) {
+	if in.scope != nil {
+		if slot, ok := in.scope.params[i.token.Raw]; ok {
+			return in.scope.values[slot], nil
+		}
+	}
+	val, ok := in.env.Get(i.token.Raw)
+	if !ok {
+		return 0, i.undefined()
+	}
+	return val, nil
+}
+
+// constants are replaced by their value, unless a parameter shadows them
+func (i *Ident) Optimize(o *Optimizer) Node {
+	if o.scope[i.token.Raw] {
+		return i
+	}
+	if val, ok := o.env.Const(i.token.Raw); ok {
+		return folded(val, i.Span())
+	}
+	return i
+}
+
+func (i *Ident) String(ident int) string {
+	return fmt.Sprint(strings.Repeat(" ", ident), i.token.Raw)
+}
+
+func (i *Ident) Span() Span {
+	return i.token.Span
+}
+
+// assigns the value of an expression to a variable, evaluates to the value
+type Assign struct {
+	token Token // name of the variable
+	value Node
+	span  Span
+}
+
+// error for assignments to constants
+func (a *Assign) constant() error {
+	return &CompileError{
+		Span: a.token.Span,
+		Code: CODE_CONSTANT_ASSIGNMENT,
+		Msg:  fmt.Sprintf("can not assign to constant %q", a.token.Raw),
+		Hint: "use a different name for the variable",
+	}
+}
+
+func (a *Assign) Compile(comp *Compiler) ([]Operation, error) {
+	if _, ok := comp.env.Const(a.token.Raw); ok {
+		return nil, a.constant()
+	}
+	// the value is compiled before declaring the variable, thus 'x = x'
+	// fails for an undefined x
+	codes, err := a.value.Compile(comp)
+	if err != nil {
+		return nil, err
+	}
+	slot := comp.env.declare(a.token.Raw)
+	codes = append(codes, comp.emit(a.span, Operation{OP_STORE_GLOBAL, float64(slot)})...)
+	return codes, nil
+}
+
+func (a *Assign) Eval(in *Interpreter) (float64, error) {
+	if _, ok := in.env.Const(a.token.Raw); ok {
+		return 0, a.constant()
+	}
+	val, err := in.eval(a.value)
+	if err != nil {
+		return 0, err
+	}
+	in.env.Set(a.token.Raw, val)
+	return val, nil
+}
+
+func (a *Assign) Optimize(o *Optimizer) Node {
+	value := a.value.Optimize(o)
+	if value == a.value {
+		return a
+	}
+	return &Assign{token: a.token, value: value, span: a.span}
+}
+
+func (a *Assign) String(ident int) string {
+	identStr := strings.Repeat(" ", ident)
+	name := &Ident{token: a.token}
+	return fmt.Sprint(identStr, "=\n ", identStr, name.String(ident+1), "\n ", identStr, a.value.String(ident+1))
+}
+
+func (a *Assign) Span() Span {
+	return a.span
+}
+
+// call of a builtin function
+type Call struct {
+	token Token // name of the function
+	args  []Node
+	span  Span
+}
+
+// looks up the builtin or user defined function and checks if it accepts the
+// amount of arguments, returns the operation calling it. fn is the function
+// whose body is compiled, nil if none, calls of it resolve to its slot before
+// it is defined
+func (c *Call) resolve(env *Env, fn *Function) (Operation, error) {
+	arityErr := func(err error) error {
+		return &CompileError{
+			Span: c.span,
+			Code: CODE_ARITY,
+			Msg:  "wrong number of arguments",
+			Err:  err,
+		}
+	}
+	if i, ok := lookupBuiltin(c.token.Raw); ok {
+		if err := BUILTINS[i].checkArity(len(c.args)); err != nil {
+			return Operation{}, arityErr(err)
+		}
+		return Operation{OP_CALL, float64(i)}, nil
+	}
+	if fn != nil && c.token.Raw == fn.Name {
+		if err := fn.checkArity(len(c.args)); err != nil {
+			return Operation{}, arityErr(err)
+		}
+		return Operation{OP_CALL_FUNC, float64(env.declareFunc(fn.Name))}, nil
+	}
+	if slot, ok := env.lookupFunc(c.token.Raw); ok && env.function(slot) != nil {
+		if err := env.function(slot).checkArity(len(c.args)); err != nil {
+			return Operation{}, arityErr(err)
+		}
+		return Operation{OP_CALL_FUNC, float64(slot)}, nil
+	}
+	return Operation{}, &CompileError{
+		Span: c.token.Span,
+		Code: CODE_UNKNOWN_FUNCTION,
+		Msg:  fmt.Sprintf("unknown function %q", c.token.Raw),
+		Hint: fmt.Sprintf("define it before calling, e.g. '%s(x) = x'", c.token.Raw),
+	}
+}
+
+// arguments are pushed onto the stack, the amount of arguments is loaded into
+// register 0 before OP_CALL or OP_CALL_FUNC
+func (c *Call) Compile(comp *Compiler) ([]Operation, error) {
+	call, err := c.resolve(comp.env, comp.fn)
+	var unknown *CompileError
+	if errors.As(err, &unknown) && unknown.Code == CODE_UNKNOWN_FUNCTION && comp.scope != nil {
+		// function bodies may call functions defined after the definition,
+		// like the tree walk interpreter the vm checks if they are defined
+		// once called
+		call, err = Operation{OP_CALL_FUNC, float64(comp.env.declareFunc(c.token.Raw))}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]Operation, 0)
+	for _, arg := range c.args {
+		argCodes, err := arg.Compile(comp)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, argCodes...)
+		codes = append(codes, comp.emit(c.span, Operation{Code: OP_PUSH})...)
+	}
+	codes = append(codes, comp.emit(c.span, Operation{OP_LOAD, float64(len(c.args))}, call)...)
+	return codes, nil
+}
+
+func (c *Call) Eval(in *Interpreter) (float64, error) {
+	call, err := c.resolve(in.env, nil)
+	if err != nil {
+		return 0, err
+	}
+	args := make([]float64, len(c.args))
+	for j, arg := range c.args {
+		args[j], err = in.eval(arg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if call.Code == OP_CALL {
+		return BUILTINS[int(call.Arg)].Fn(args), nil
+	}
+
+	f := in.env.function(int(call.Arg))
+	if in.MaxCallDepth > 0 {
+		if in.depth >= in.MaxCallDepth {
+			return 0, &BudgetError{Budget: BUDGET_CALL_DEPTH, Limit: in.MaxCallDepth, Pos: -1, Span: c.span}
+		}
+	} else if in.depth >= MAX_CALL_DEPTH {
+		return 0, &StackOverflowError{Function: f.Name, Depth: MAX_CALL_DEPTH}
+	}
+	caller := in.scope
+	in.scope = &scope{params: f.scope().params, values: args}
+	in.depth++
+	defer func() {
+		in.scope = caller
+		in.depth--
+	}()
+	return in.eval(f.Body)
+}
+
+// calls of builtins with constant arguments are replaced by their result,
+// user defined functions are never folded, they can be redefined
+func (c *Call) Optimize(o *Optimizer) Node {
+	args := make([]Node, len(c.args))
+	values := make([]float64, len(c.args))
+	allConst, changed := true, false
+	for j, arg := range c.args {
+		args[j] = arg.Optimize(o)
+		changed = changed || args[j] != arg
+		var ok bool
+		values[j], ok = constant(args[j])
+		allConst = allConst && ok
+	}
+	if i, ok := lookupBuiltin(c.token.Raw); ok && allConst && BUILTINS[i].checkArity(len(args)) == nil {
+		return folded(BUILTINS[i].Fn(values), c.span)
+	}
+	if !changed {
+		return c
+	}
+	return &Call{token: c.token, args: args, span: c.span}
+}
+
+func (c *Call) String(ident int) string {
+	identStr := strings.Repeat(" ", ident)
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprint(identStr, c.token.Raw, "()"))
+	for _, arg := range c.args {
+		b.WriteString(fmt.Sprint("\n ", identStr, arg.String(ident+1)))
+	}
+	return b.String()
+}
+
+func (c *Call) Span() Span {
+	return c.span
+}
+
+// definition of a function, f(x, y) = x^2 + y
+type FuncDef struct {
+	token  Token   // name of the function
+	params []Token // names of the parameters
+	body   Node
+	span   Span
+}
+
+// checks that neither the function shadows a builtin nor a parameter shadows
+// a constant
+func (f *FuncDef) validate(env *Env) error {
+	if _, ok := lookupBuiltin(f.token.Raw); ok {
+		return &CompileError{
+			Span: f.token.Span,
+			Code: CODE_BUILTIN_REDEFINITION,
+			Msg:  fmt.Sprintf("can not redefine builtin %q", f.token.Raw),
+			Hint: "use a different name for the function",
+		}
+	}
+	for _, param := range f.params {
+		if _, ok := env.Const(param.Raw); ok {
+			return &CompileError{
+				Span: param.Span,
+				Code: CODE_CONSTANT_ASSIGNMENT,
+				Msg:  fmt.Sprintf("can not use constant %q as a parameter", param.Raw),
+				Hint: "use a different name for the parameter",
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FuncDef) function() *Function {
+	params := make([]string, len(f.params))
+	for i, p := range f.params {
+		params[i] = p.Raw
+	}
+	return &Function{Name: f.token.Raw, Params: params, Body: f.body}
+}
+
+// compiles the body into the separate chunk of the function and defines it
+// in env, emits no operations. The function is only defined once its body
+// compiled, until then calls of it from other goroutines execute the
+// previous definition
+func (f *FuncDef) Compile(comp *Compiler) ([]Operation, error) {
+	if err := f.validate(comp.env); err != nil {
+		return nil, err
+	}
+	_, declared := comp.env.lookupFunc(f.token.Raw)
+
+	// the body is a separate chunk with its own spans
+	fn := f.function()
+	outer := comp.spans
+	comp.scope, comp.fn, comp.spans = fn.scope(), fn, nil
+	defer func() { comp.scope, comp.fn, comp.spans = nil, nil, outer }()
+	codes, err := f.body.Compile(comp)
+	if err != nil {
+		if !declared {
+			// removes the slot a recursive call in the body declared
+			comp.env.undefineFunc(f.token.Raw)
+		}
+		return nil, err
+	}
+	codes = append(codes, comp.emit(f.span, Operation{Code: OP_RETURN})...)
+	fn.Code, fn.Spans = comp.optimize(codes, comp.spans)
+	comp.env.defineFunc(fn)
+	return []Operation{}, nil
+}
+
+// defines the function in env, evaluates to 0
+func (f *FuncDef) Eval(in *Interpreter) (float64, error) {
+	if err := f.validate(in.env); err != nil {
+		return 0, err
+	}
+	in.env.defineFunc(f.function())
+	return 0, nil
+}
+
+// parameters shadow constants in the body, the body is optimized with
+// them in scope
+func (f *FuncDef) Optimize(o *Optimizer) Node {
+	outer := o.scope
+	o.scope = make(map[string]bool, len(f.params))
+	for _, p := range f.params {
+		o.scope[p.Raw] = true
+	}
+	body := f.body.Optimize(o)
+	o.scope = outer
+	if body == f.body {
+		return f
+	}
+	return &FuncDef{token: f.token, params: f.params, body: body, span: f.span}
+}
+
+func (f *FuncDef) String(ident int) string {
+	identStr := strings.Repeat(" ", ident)
+	params := make([]string, len(f.params))
+	for i, p := range f.params {
+		params[i] = p.Raw
+	}
+	return fmt.Sprint(identStr, f.token.Raw, "(", strings.Join(params, ", "), ") =\n ", identStr, f.body.String(ident+1))
+}
+
+func (f *FuncDef) Span() Span {
+	return f.span
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
-	"log"
 	"strings"
 )
 
@@ -11,53 +11,98 @@ const (
 	TOKEN_UNKNOWN = iota + 1
 
 	TOKEN_NUMBER
+	TOKEN_IDENT
+	TOKEN_EQUAL
 	TOKEN_PLUS
 	TOKEN_MINUS
 	TOKEN_ASTERISK
 	TOKEN_SLASH
+	TOKEN_DOUBLE_SLASH
+	TOKEN_PERCENT
+	TOKEN_CARET
 
 	TOKEN_BRACE_LEFT
 	TOKEN_BRACE_RIGHT
+	TOKEN_COMMA
 
 	TOKEN_EOF
+	TOKEN_NEWLINE // end of a statement at a line break, inserted by the parser
 )
 
 // for debugging
 var TOKEN_LOOKUP = map[int]string{
-	TOKEN_UNKNOWN:     "UNKNOWN",
-	TOKEN_NUMBER:      "TOKEN_NUMBER",
-	TOKEN_PLUS:        "TOKEN_PLUS",
-	TOKEN_MINUS:       "TOKEN_MINUS",
-	TOKEN_ASTERISK:    "TOKEN_ASTERISK",
-	TOKEN_SLASH:       "TOKEN_SLASH",
-	TOKEN_BRACE_LEFT:  "TOKEN_BRACE_LEFT",
-	TOKEN_BRACE_RIGHT: "TOKEN_BRACE_RIGHT",
-	TOKEN_EOF:         "EOF",
+	TOKEN_UNKNOWN:      "UNKNOWN",
+	TOKEN_NUMBER:       "TOKEN_NUMBER",
+	TOKEN_IDENT:        "TOKEN_IDENT",
+	TOKEN_EQUAL:        "TOKEN_EQUAL",
+	TOKEN_PLUS:         "TOKEN_PLUS",
+	TOKEN_MINUS:        "TOKEN_MINUS",
+	TOKEN_ASTERISK:     "TOKEN_ASTERISK",
+	TOKEN_SLASH:        "TOKEN_SLASH",
+	TOKEN_DOUBLE_SLASH: "TOKEN_DOUBLE_SLASH",
+	TOKEN_PERCENT:      "TOKEN_PERCENT",
+	TOKEN_CARET:        "TOKEN_CARET",
+	TOKEN_BRACE_LEFT:   "TOKEN_BRACE_LEFT",
+	TOKEN_BRACE_RIGHT:  "TOKEN_BRACE_RIGHT",
+	TOKEN_COMMA:        "TOKEN_COMMA",
+	TOKEN_EOF:          "EOF",
+	TOKEN_NEWLINE:      "NEWLINE",
+}
+
+// location of a character in the input
+type Position struct {
+	Offset int // byte offset, starting at 0
+	Line   int // line, starting at 1
+	Col    int // column in characters, starting at 1
+}
+
+// formats the position as line:column
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// range of characters in the input, End points after the last character
+type Span struct {
+	Start Position
+	End   Position
 }
 
 type Token struct {
 	Type int
 	Raw  string
+	Span Span // location of the token in the input
 }
 
 type Lexer struct {
 	scanner bufio.Reader
 	cur     rune
+	pos     Position // position of cur
+	next    Position // position of the character after cur
 }
 
 func NewLexer(reader io.Reader) *Lexer {
+	return NewLexerAt(reader, Position{Offset: 0, Line: 1, Col: 1})
+}
+
+// like NewLexer, the first character of reader is at start. Used for lexing
+// a part of a larger input, the spans of the tokens are positions in it
+func NewLexerAt(reader io.Reader, start Position) *Lexer {
 	l := &Lexer{
 		scanner: *bufio.NewReader(reader),
+		next:    start,
 	}
 	l.advance()
 	return l
 }
 
-// transform list of characters to list of tokens
-func (l *Lexer) Lex() []Token {
+// transform list of characters to list of tokens, returns a *LexError for
+// characters not part of the language
+func (l *Lexer) Lex() ([]Token, error) {
 	t := make([]Token, 0)
 	for l.cur != 0 {
 		ttype := TOKEN_UNKNOWN
+		start := l.pos
+		raw := string(l.cur)
 
 		switch l.cur {
 		case '#':
@@ -68,32 +113,54 @@ func (l *Lexer) Lex() []Token {
 		case ' ', '\n', '\t', '\r':
 			l.advance()
 			continue
+		case '=':
+			ttype = TOKEN_EQUAL
 		case '+':
 			ttype = TOKEN_PLUS
 		case '-':
 			ttype = TOKEN_MINUS
 		case '/':
 			ttype = TOKEN_SLASH
+			if l.peek() == '/' {
+				l.advance()
+				ttype = TOKEN_DOUBLE_SLASH
+				raw = "//"
+			}
+		case '%':
+			ttype = TOKEN_PERCENT
 		case '*':
 			ttype = TOKEN_ASTERISK
+			if l.peek() == '*' {
+				l.advance()
+				ttype = TOKEN_CARET
+				raw = "**"
+			}
+		case '^':
+			ttype = TOKEN_CARET
 		case '(':
 			ttype = TOKEN_BRACE_LEFT
 		case ')':
 			ttype = TOKEN_BRACE_RIGHT
+		case ',':
+			ttype = TOKEN_COMMA
 		default:
 			if (l.cur >= '0' && l.cur <= '9') || l.cur == '.' {
 				t = append(t, l.number())
 				continue
+			} else if isIdentStart(l.cur) {
+				t = append(t, l.ident())
+				continue
 			}
 		}
 
 		if ttype != TOKEN_UNKNOWN {
 			t = append(t, Token{
 				Type: ttype,
-				Raw:  string(l.cur),
+				Raw:  raw,
+				Span: Span{Start: start, End: l.next},
 			})
 		} else {
-			log.Fatalf("unknown %q in input", l.cur)
+			return nil, &LexError{Rune: l.cur, Span: Span{Start: start, End: l.next}}
 		}
 
 		l.advance()
@@ -101,12 +168,14 @@ func (l *Lexer) Lex() []Token {
 	t = append(t, Token{
 		Type: TOKEN_EOF,
 		Raw:  "TOKEN_EOF",
+		Span: Span{Start: l.pos, End: l.pos},
 	})
-	return t
+	return t, nil
 }
 
 // advances until cur char is no longer [0-9\._e], returns token with list of matching chars
 func (l *Lexer) number() Token {
+	start := l.pos
 	b := strings.Builder{}
 	for (l.cur >= '0' && l.cur <= '9') || l.cur == '.' || l.cur == '_' || l.cur == 'e' {
 		b.WriteRune(l.cur)
@@ -115,15 +184,54 @@ func (l *Lexer) number() Token {
 	return Token{
 		Raw:  b.String(),
 		Type: TOKEN_NUMBER,
+		Span: Span{Start: start, End: l.pos},
 	}
 }
 
-// advance to the next character
-func (l *Lexer) advance() {
+// advances until cur char is no longer [a-zA-Z0-9_], returns token with list of matching chars
+func (l *Lexer) ident() Token {
+	start := l.pos
+	b := strings.Builder{}
+	for isIdentStart(l.cur) || (l.cur >= '0' && l.cur <= '9') {
+		b.WriteRune(l.cur)
+		l.advance()
+	}
+	return Token{
+		Raw:  b.String(),
+		Type: TOKEN_IDENT,
+		Span: Span{Start: start, End: l.pos},
+	}
+}
+
+// identifiers start with [a-zA-Z_]
+func isIdentStart(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_'
+}
+
+// returns the character after cur without advancing
+func (l *Lexer) peek() rune {
 	r, _, err := l.scanner.ReadRune()
+	if err != nil {
+		return 0
+	}
+	l.scanner.UnreadRune()
+	return r
+}
+
+// advance to the next character, keeps track of its position
+func (l *Lexer) advance() {
+	l.pos = l.next
+	r, size, err := l.scanner.ReadRune()
 	if err != nil {
 		l.cur = 0
+		return
+	}
+	l.cur = r
+	l.next.Offset += size
+	if r == '\n' {
+		l.next.Line++
+		l.next.Col = 1
 	} else {
-		l.cur = r
+		l.next.Col++
 	}
 }
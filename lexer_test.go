@@ -7,6 +7,14 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// span of a token on a single line
+func span(line, col, start, end int) Span {
+	return Span{
+		Start: Position{Offset: start, Line: line, Col: col},
+		End:   Position{Offset: end, Line: line, Col: col + end - start},
+	}
+}
+
 func TestLexer(t *testing.T) {
 	tests := []struct {
 		Name string
@@ -17,91 +25,192 @@ func TestLexer(t *testing.T) {
 			Name: "empty input",
 			In:   "",
 			Out: []Token{
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 1, 0, 0)},
 			},
 		},
 		{
 			Name: "whitespace",
 			In:   "\r\n\t             ",
 			Out: []Token{
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_EOF, "TOKEN_EOF", span(2, 15, 16, 16)},
 			},
 		},
 		{
 			Name: "comment",
 			In:   "# this is a comment",
 			Out: []Token{
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 20, 19, 19)},
 			},
 		},
 		{
 			Name: "symbols",
 			In:   "+-/*()",
 			Out: []Token{
-				{TOKEN_PLUS, "+"},
-				{TOKEN_MINUS, "-"},
-				{TOKEN_SLASH, "/"},
-				{TOKEN_ASTERISK, "*"},
-				{TOKEN_BRACE_LEFT, "("},
-				{TOKEN_BRACE_RIGHT, ")"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_PLUS, "+", span(1, 1, 0, 1)},
+				{TOKEN_MINUS, "-", span(1, 2, 1, 2)},
+				{TOKEN_SLASH, "/", span(1, 3, 2, 3)},
+				{TOKEN_ASTERISK, "*", span(1, 4, 3, 4)},
+				{TOKEN_BRACE_LEFT, "(", span(1, 5, 4, 5)},
+				{TOKEN_BRACE_RIGHT, ")", span(1, 6, 5, 6)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 7, 6, 6)},
+			},
+		},
+		{
+			Name: "power",
+			In:   "^**",
+			Out: []Token{
+				{TOKEN_CARET, "^", span(1, 1, 0, 1)},
+				{TOKEN_CARET, "**", span(1, 2, 1, 3)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 4, 3, 3)},
+			},
+		},
+		{
+			Name: "modulo and floor division",
+			In:   "% // /",
+			Out: []Token{
+				{TOKEN_PERCENT, "%", span(1, 1, 0, 1)},
+				{TOKEN_DOUBLE_SLASH, "//", span(1, 3, 2, 4)},
+				{TOKEN_SLASH, "/", span(1, 6, 5, 6)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 7, 6, 6)},
+			},
+		},
+		{
+			Name: "multiplication is not power",
+			In:   "* *",
+			Out: []Token{
+				{TOKEN_ASTERISK, "*", span(1, 1, 0, 1)},
+				{TOKEN_ASTERISK, "*", span(1, 3, 2, 3)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 4, 3, 3)},
+			},
+		},
+		{
+			Name: "identifiers and assignment",
+			In:   "x = foo_1+_a",
+			Out: []Token{
+				{TOKEN_IDENT, "x", span(1, 1, 0, 1)},
+				{TOKEN_EQUAL, "=", span(1, 3, 2, 3)},
+				{TOKEN_IDENT, "foo_1", span(1, 5, 4, 9)},
+				{TOKEN_PLUS, "+", span(1, 10, 9, 10)},
+				{TOKEN_IDENT, "_a", span(1, 11, 10, 12)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 13, 12, 12)},
+			},
+		},
+		{
+			Name: "call",
+			In:   "max(1,x)",
+			Out: []Token{
+				{TOKEN_IDENT, "max", span(1, 1, 0, 3)},
+				{TOKEN_BRACE_LEFT, "(", span(1, 4, 3, 4)},
+				{TOKEN_NUMBER, "1", span(1, 5, 4, 5)},
+				{TOKEN_COMMA, ",", span(1, 6, 5, 6)},
+				{TOKEN_IDENT, "x", span(1, 7, 6, 7)},
+				{TOKEN_BRACE_RIGHT, ")", span(1, 8, 7, 8)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 9, 8, 8)},
 			},
 		},
 		{
 			Name: "number",
 			In:   "123",
 			Out: []Token{
-				{TOKEN_NUMBER, "123"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_NUMBER, "123", span(1, 1, 0, 3)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 4, 3, 3)},
 			},
 		},
 		{
 			Name: "number with underscore",
 			In:   "10_000",
 			Out: []Token{
-				{TOKEN_NUMBER, "10_000"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_NUMBER, "10_000", span(1, 1, 0, 6)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 7, 6, 6)},
 			},
 		},
 		{
 			Name: "number with e",
 			In:   "10e5",
 			Out: []Token{
-				{TOKEN_NUMBER, "10e5"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_NUMBER, "10e5", span(1, 1, 0, 4)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 5, 4, 4)},
 			},
 		},
 		{
 			Name: "number with .",
 			In:   "0.005",
 			Out: []Token{
-				{TOKEN_NUMBER, "0.005"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_NUMBER, "0.005", span(1, 1, 0, 5)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 6, 5, 5)},
 			},
 		},
 		{
 			Name: "number with . and underscore",
 			In:   "1_000_000.0_000_5",
 			Out: []Token{
-				{TOKEN_NUMBER, "1_000_000.0_000_5"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_NUMBER, "1_000_000.0_000_5", span(1, 1, 0, 17)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 18, 17, 17)},
 			},
 		},
 		{
-			In: "1_000_000.0_000_5+5",
+			Name: "number followed by operator",
+			In:   "1_000_000.0_000_5+5",
 			Out: []Token{
-				{TOKEN_NUMBER, "1_000_000.0_000_5"},
-				{TOKEN_PLUS, "+"},
-				{TOKEN_NUMBER, "5"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{TOKEN_NUMBER, "1_000_000.0_000_5", span(1, 1, 0, 17)},
+				{TOKEN_PLUS, "+", span(1, 18, 17, 18)},
+				{TOKEN_NUMBER, "5", span(1, 19, 18, 19)},
+				{TOKEN_EOF, "TOKEN_EOF", span(1, 20, 19, 19)},
 			},
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
 			in := strings.NewReader(test.In)
-			out := NewLexer(in).Lex()
+			out, err := NewLexer(in).Lex()
+			assert.NoError(t, err)
 			assert.EqualValues(t, test.Out, out)
 		})
 	}
 }
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		Name string
+		In   string
+		Rune rune
+		Span Span
+	}{
+		{Name: "unknown character", In: "?", Rune: '?', Span: span(1, 1, 0, 1)},
+		{Name: "unknown character after number", In: "1+2$", Rune: '$', Span: span(1, 4, 3, 4)},
+		{Name: "unknown character on second line", In: "1\n ?", Rune: '?', Span: span(2, 2, 3, 4)},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := NewLexer(strings.NewReader(test.In)).Lex()
+			var lexErr *LexError
+			if assert.ErrorAs(t, err, &lexErr) {
+				assert.Equal(t, test.Rune, lexErr.Rune)
+				assert.Equal(t, test.Span, lexErr.Span)
+			}
+		})
+	}
+}
+
+func TestLexerMultiline(t *testing.T) {
+	out, err := NewLexer(strings.NewReader("1+1\n# comment\n  2")).Lex()
+	assert.NoError(t, err)
+	assert.EqualValues(t, []Token{
+		{TOKEN_NUMBER, "1", span(1, 1, 0, 1)},
+		{TOKEN_PLUS, "+", span(1, 2, 1, 2)},
+		{TOKEN_NUMBER, "1", span(1, 3, 2, 3)},
+		{TOKEN_NUMBER, "2", span(3, 3, 16, 17)},
+		{TOKEN_EOF, "TOKEN_EOF", span(3, 4, 17, 17)},
+	}, out)
+}
+
+func TestLexerAt(t *testing.T) {
+	out, err := NewLexerAt(strings.NewReader("x+2"), Position{Offset: 10, Line: 4, Col: 1}).Lex()
+	assert.NoError(t, err)
+	assert.EqualValues(t, []Token{
+		{TOKEN_IDENT, "x", span(4, 1, 10, 11)},
+		{TOKEN_PLUS, "+", span(4, 2, 11, 12)},
+		{TOKEN_NUMBER, "2", span(4, 3, 12, 13)},
+		{TOKEN_EOF, "TOKEN_EOF", span(4, 4, 13, 13)},
+	}, out)
+}
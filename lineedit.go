@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// reads lines of input with a prompt
+type LineReader interface {
+	// returns the next line without its line break, io.EOF once the input ended
+	ReadLine(prompt string) (string, error)
+	// makes line available to the history of the reader
+	AddHistory(line string)
+}
+
+// creates a LineEditor if in is a terminal supporting line editing,
+// otherwise a reader printing the prompt and reading lines without editing
+func NewLineReader(in *os.File, out io.Writer) LineReader {
+	if isTerminal(in) {
+		if restore, err := makeRaw(int(in.Fd())); err == nil {
+			restore()
+			return &LineEditor{fd: int(in.Fd()), in: bufio.NewReader(in), out: out}
+		}
+	}
+	return &plainReader{scanner: bufio.NewScanner(in), out: out}
+}
+
+// reads lines without editing, used if the input is not a terminal
+type plainReader struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+func (r *plainReader) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return r.scanner.Text(), nil
+}
+
+func (r *plainReader) AddHistory(line string) {}
+
+// LineEditor reads lines from a terminal in raw mode and supports editing
+// them:
+//
+//   - left, right, ctrl-b and ctrl-f move the cursor
+//   - home, end, ctrl-a and ctrl-e move to the start and the end of the line
+//   - backspace and delete remove characters, ctrl-u and ctrl-k remove
+//     everything before and after the cursor
+//   - up and down, ctrl-p and ctrl-n walk through the history
+//   - ctrl-c discards the line, ctrl-d on an empty line ends the input
+type LineEditor struct {
+	fd      int
+	in      *bufio.Reader
+	out     io.Writer
+	History []string // oldest line first
+}
+
+func (e *LineEditor) AddHistory(line string) {
+	if len(e.History) == 0 || e.History[len(e.History)-1] != line {
+		e.History = append(e.History, line)
+	}
+}
+
+func (e *LineEditor) ReadLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	return e.edit(prompt)
+}
+
+// state of the line being edited
+type editState struct {
+	prompt  string
+	buf     []rune
+	pos     int    // cursor position in buf
+	history int    // index of the history entry shown, len(History) for the new line
+	pending string // the new line, saved while walking through the history
+}
+
+// reads keys from the input until the line is complete, expects the terminal
+// to be in raw mode
+func (e *LineEditor) edit(prompt string) (string, error) {
+	s := &editState{prompt: prompt, history: len(e.History)}
+	e.refresh(s)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			fmt.Fprint(e.out, "\r\n")
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(s.buf), nil
+		case 3: // ctrl-c
+			fmt.Fprint(e.out, "^C\r\n")
+			s.buf, s.pos = nil, 0
+			e.refresh(s)
+			continue
+		case 4: // ctrl-d
+			if len(s.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			s.remove(s.pos)
+		case 127, 8: // backspace, ctrl-h
+			if s.pos > 0 {
+				s.pos--
+				s.remove(s.pos)
+			}
+		case 1: // ctrl-a
+			s.pos = 0
+		case 5: // ctrl-e
+			s.pos = len(s.buf)
+		case 2: // ctrl-b
+			s.move(-1)
+		case 6: // ctrl-f
+			s.move(1)
+		case 11: // ctrl-k
+			s.buf = s.buf[:s.pos]
+		case 21: // ctrl-u
+			s.buf, s.pos = s.buf[s.pos:], 0
+		case 16: // ctrl-p
+			e.walkHistory(s, -1)
+		case 14: // ctrl-n
+			e.walkHistory(s, 1)
+		case 27: // escape sequence
+			e.escape(s)
+		default:
+			if unicode.IsPrint(r) {
+				s.buf = append(s.buf[:s.pos], append([]rune{r}, s.buf[s.pos:]...)...)
+				s.pos++
+			}
+		}
+		e.refresh(s)
+	}
+}
+
+// handles the escape sequences of the arrow, home, end and delete keys.
+// Terminals send a sequence at once, an escape without further buffered input
+// is the escape key itself and ignored instead of waiting for the next key,
+// like an escape that does not start a sequence
+func (e *LineEditor) escape(s *editState) {
+	if e.in.Buffered() == 0 {
+		return
+	}
+	if next, err := e.in.Peek(1); err != nil || (next[0] != '[' && next[0] != 'O') {
+		return
+	}
+	e.in.ReadByte()
+	b, err := e.in.ReadByte()
+	if err != nil {
+		return
+	}
+	switch b {
+	case 'A':
+		e.walkHistory(s, -1)
+	case 'B':
+		e.walkHistory(s, 1)
+	case 'C':
+		s.move(1)
+	case 'D':
+		s.move(-1)
+	case 'H':
+		s.pos = 0
+	case 'F':
+		s.pos = len(s.buf)
+	case '1', '3', '4', '7', '8':
+		// home, delete and end as '<number>~'
+		if next, err := e.in.ReadByte(); err != nil || next != '~' {
+			return
+		}
+		switch b {
+		case '1', '7':
+			s.pos = 0
+		case '4', '8':
+			s.pos = len(s.buf)
+		case '3':
+			s.remove(s.pos)
+		}
+	}
+}
+
+// replaces the line with the previous (-1) or next (1) history entry
+func (e *LineEditor) walkHistory(s *editState, direction int) {
+	next := s.history + direction
+	if next < 0 || next > len(e.History) {
+		return
+	}
+	if s.history == len(e.History) {
+		s.pending = string(s.buf)
+	}
+	s.history = next
+	if next == len(e.History) {
+		s.buf = []rune(s.pending)
+	} else {
+		s.buf = []rune(e.History[next])
+	}
+	s.pos = len(s.buf)
+}
+
+// redraws the prompt and the line, places the cursor
+func (e *LineEditor) refresh(s *editState) {
+	b := strings.Builder{}
+	b.WriteString("\r")
+	b.WriteString(s.prompt)
+	b.WriteString(string(s.buf))
+	// clear the rest of a previously longer line
+	b.WriteString("\x1b[K")
+	if back := len(s.buf) - s.pos; back > 0 {
+		fmt.Fprintf(&b, "\x1b[%dD", back)
+	}
+	io.WriteString(e.out, b.String())
+}
+
+// moves the cursor by delta, stays inside the line
+func (s *editState) move(delta int) {
+	s.pos += delta
+	if s.pos < 0 {
+		s.pos = 0
+	}
+	if s.pos > len(s.buf) {
+		s.pos = len(s.buf)
+	}
+}
+
+// removes the character at i, if any
+func (s *editState) remove(i int) {
+	if i < len(s.buf) {
+		s.buf = append(s.buf[:i], s.buf[i+1:]...)
+	}
+}
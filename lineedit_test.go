@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineEditor(t *testing.T) {
+	cases := []struct {
+		name string
+		keys string
+		want string
+	}{
+		{"plain", "1+2\r", "1+2"},
+		{"insert after moving left", "abc\x1b[D\x1b[DX\r", "aXbc"},
+		{"home and end", "bc\x01a\x05d\r", "abcd"},
+		{"home and end keys", "bc\x1b[Ha\x1b[Fd\x1b[1~_\x1b[4~!\r", "_abcd!"},
+		{"backspace", "abc\x7f\x7fd\r", "ad"},
+		{"delete", "abc\x1b[D\x1b[D\x1b[3~\r", "ac"},
+		{"kill to end", "abcd\x02\x02\x0b\r", "ab"},
+		{"kill to start", "abcd\x02\x15\r", "d"},
+		{"ctrl-c discards the line", "abc\x03d\r", "d"},
+		{"previous entry", "\x1b[A\r", "x = 2"},
+		{"oldest entry", "\x1b[A\x1b[A\x1b[A\x1b[A\r", "1+1"},
+		{"back to the new line", "new\x10\x0e\r", "new"},
+		{"edit entry", "\x1b[A\x7f3\r", "x = 3"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := &LineEditor{in: bufio.NewReader(strings.NewReader(c.keys)), out: io.Discard, History: []string{"1+1", "x = 2"}}
+			line, err := e.edit("> ")
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, line)
+		})
+	}
+}
+
+func TestLineEditorEscapeKey(t *testing.T) {
+	// the escape key arrives on its own, the following keys in a later read
+	in := io.MultiReader(strings.NewReader("a\x1b"), strings.NewReader("b\x1b[D\r"))
+	e := &LineEditor{in: bufio.NewReader(in), out: io.Discard}
+	line, err := e.edit("> ")
+	assert.NoError(t, err)
+	assert.Equal(t, "ab", line)
+
+	// an escape that does not start a sequence keeps the following key
+	e = &LineEditor{in: bufio.NewReader(strings.NewReader("a\x1bb\r")), out: io.Discard}
+	line, err = e.edit("> ")
+	assert.NoError(t, err)
+	assert.Equal(t, "ab", line)
+}
+
+func TestLineEditorEOF(t *testing.T) {
+	out := &strings.Builder{}
+	e := &LineEditor{in: bufio.NewReader(strings.NewReader("ab\x04\x01\x04\r\x04")), out: out}
+	line, err := e.edit("> ")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", line)
+	_, err = e.edit("> ")
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Contains(t, out.String(), "\r> b\x1b[K\x1b[1D")
+}
+
+func TestLineEditorHistory(t *testing.T) {
+	e := &LineEditor{}
+	e.AddHistory("1")
+	e.AddHistory("1")
+	e.AddHistory("2")
+	assert.Equal(t, []string{"1", "2"}, e.History)
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 func debugToken(token []Token) {
-	log.Printf("%5s | %15s | %15s \n\n", "index", "type", "raw")
+	log.Printf("%5s | %15s | %15s | %7s \n\n", "index", "type", "raw", "pos")
 	for i, t := range token {
-		log.Printf("%5d | %15s | %15s \n", i, TOKEN_LOOKUP[t.Type], t.Raw)
+		log.Printf("%5d | %15s | %15s | %7s \n", i, TOKEN_LOOKUP[t.Type], t.Raw, t.Span.Start)
 	}
 }
 
@@ -20,22 +24,462 @@ func debugAst(ast []Node) {
 	}
 }
 
+// parses the flags in args. An argument starting with '-' that is not the name
+// of a flag is an expression such as "-2^2" or "-pi" and ends the flags
+// instead of being rejected as an unknown flag
+func parseFlags(fs *flag.FlagSet, args []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := fs.Lookup(name)
+		if f == nil && name != "h" && name != "help" {
+			args = append(append(args[:i:i], "--"), args[i:]...)
+			break
+		}
+		// skips the value of flags given as '-name value'
+		if f != nil && !hasValue {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				i++
+			}
+		}
+	}
+	fs.Parse(args)
+}
+
+// renders err as a diagnostic for input and exits
+func fatal(input string, err error) {
+	RenderError(os.Stderr, input, err)
+	os.Exit(1)
+}
+
 func main() {
 	log.SetFlags(0)
-	if len(os.Args) != 2 {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "compile":
+			compileCommand(os.Args[2:])
+			return
+		case "run":
+			runCommand(os.Args[2:])
+			return
+		case "debug":
+			debugCommand(os.Args[2:])
+			return
+		}
+	}
+
+	backend := flag.String("backend", "vm", "execution backend: 'vm' compiles to bytecode, 'tree' walks the syntax tree")
+	optimize := flag.Bool("optimize", true, "fold constant subtrees and simplify expressions before execution")
+	showOptimized := flag.Bool("show-optimized", false, "print the optimized abstract syntax tree after the parsed one")
+	peephole := flag.Bool("peephole", true, "rewrite sequences of operations to shorter ones after compiling")
+	disassemble := flag.Bool("disassemble", false, "print the compiled bytecode as assembly")
+	file := flag.String("f", "", "evaluate every line of the file on its own, '-' reads from stdin")
+	vmOptions := newVmFlags(flag.CommandLine)
+	parseFlags(flag.CommandLine, os.Args[1:])
+	if *backend != "vm" && *backend != "tree" {
+		log.Fatalf("unknown backend %q, use 'vm' or 'tree'", *backend)
+	}
+
+	// 'calc -f file', 'calc -' and 'cat file | calc' evaluate line by line
+	if *file != "" && flag.NArg() > 0 {
+		log.Fatalf("unexpected arguments %q, -f evaluates the file only", flag.Args())
+	}
+	if *file == "" && flag.NArg() == 1 && flag.Arg(0) == "-" {
+		*file = "-"
+	}
+	if *file == "" && flag.NArg() == 0 && !isTerminal(os.Stdin) {
+		*file = "-"
+	}
+	rejectIgnoredFlags(*backend, *optimize, *file == "" && flag.NArg() > 0)
+	if *file != "" {
+		env := NewEnv()
+		failed := evalFile(*file, func(ast []Node) ([]float64, error) {
+			if *optimize {
+				ast = Optimize(env, ast)
+			}
+			if *backend == "tree" {
+				return vmOptions.evaluate(env, ast)
+			}
+			compiler := NewCompiler(env)
+			compiler.Peephole = *peephole
+			byteCode, err := compiler.Compile(ast)
+			if err != nil {
+				return nil, err
+			}
+			vm, err := vmOptions.execute(env, byteCode)
+			if err != nil {
+				return nil, err
+			}
+			return vm.Results(), nil
+		})
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() == 0 {
+		runRepl(*backend, *optimize, *peephole, vmOptions)
+		return
+	}
+	if flag.NArg() != 1 {
 		log.Fatalln("missing input")
 	}
 
-	input := os.Args[1]
+	input := flag.Arg(0)
+	if strings.HasSuffix(input, ".casm") {
+		runAssembly(input, vmOptions)
+		return
+	}
+	if strings.HasSuffix(input, ".calcb") {
+		runBytecode(input, false, vmOptions)
+		return
+	}
 
-	token := NewLexer(strings.NewReader(input)).Lex()
+	token, err := NewLexer(strings.NewReader(input)).Lex()
+	if err != nil {
+		fatal(input, err)
+	}
 	debugToken(token)
 
-	ast := NewParser(token).Parse()
+	ast, err := NewParser(token).Parse()
+	if err != nil {
+		fatal(input, err)
+	}
 	debugAst(ast)
 
-	byteCode := Compile(ast)
-	vm := Vm{trace: true}
-	vm.NewVmIn(byteCode).Execute()
-	fmt.Printf("=> %f\n", vm.reg[0])
+	env := NewEnv()
+	if *optimize {
+		ast = Optimize(env, ast)
+		if *showOptimized {
+			log.Println("optimized:")
+			debugAst(ast)
+		}
+	}
+
+	if *backend == "tree" {
+		results, err := vmOptions.evaluate(env, ast)
+		if err != nil {
+			fatal(input, err)
+		}
+		printResults(results)
+		return
+	}
+
+	compiler := NewCompiler(env)
+	compiler.Peephole = *peephole
+	byteCode, err := compiler.Compile(ast)
+	if err != nil {
+		fatal(input, err)
+	}
+	if *peephole {
+		log.Println("peephole:", compiler.Report)
+	}
+	if *disassemble {
+		Disassemble(log.Writer(), NewProgram(env, byteCode, compiler.Spans), input)
+	}
+	vm, err := vmOptions.execute(env, byteCode)
+	if err != nil {
+		fatal(input, err)
+	}
+	printResults(vm.Results())
+}
+
+// exits if a flag set on the command line has no effect on the backend or on
+// the input, single is false for -f and the repl
+func rejectIgnoredFlags(backend string, optimize, single bool) {
+	bytecode := single && (strings.HasSuffix(flag.Arg(0), ".casm") || strings.HasSuffix(flag.Arg(0), ".calcb"))
+	flag.Visit(func(f *flag.Flag) {
+		if f.Value.String() == f.DefValue {
+			return
+		}
+		reason := ""
+		switch {
+		case f.Name == "backend" && bytecode:
+			reason = "has no effect on .casm and .calcb files, the vm executes them"
+		case backend == "tree" && (f.Name == "peephole" || f.Name == "disassemble"):
+			reason = "requires -backend vm, the tree walk interpreter compiles no bytecode"
+		case backend == "tree" && (f.Name == "trace" || f.Name == "trace-file"):
+			reason = "requires -backend vm, the tree walk interpreter executes no operations"
+		case f.Name == "show-optimized" && !optimize:
+			reason = "requires -optimize"
+		case (f.Name == "disassemble" || f.Name == "show-optimized") && !single:
+			reason = "requires a single expression, it has no effect with -f or the repl"
+		}
+		if reason != "" {
+			log.Fatalf("-%s %s", f.Name, reason)
+		}
+	})
+}
+
+// evaluates the lines of the file at path, of stdin if path is '-', see
+// EvalLines. Returns the amount of failed lines
+func evalFile(path string, eval func(ast []Node) ([]float64, error)) int {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	failed, err := EvalLines(r, os.Stdout, os.Stderr, eval)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return failed
+}
+
+// starts the repl on stdin, keeps the history in the configuration directory
+// of the user
+func runRepl(backend string, optimize, peephole bool, options *vmFlags) {
+	in := NewLineReader(os.Stdin, os.Stdout)
+	repl := NewRepl(in, os.Stdout)
+	repl.Backend, repl.Optimize, repl.Peephole = backend, optimize, peephole
+	repl.MaxInstructions, repl.MaxCallDepth = *options.maxInstructions, *options.maxCallDepth
+	repl.Timeout, repl.Trace = *options.timeout, newTracer(*options.trace, *options.traceFile)
+	if path, err := DefaultHistoryFile(); err == nil {
+		repl.HistoryFile = path
+	}
+	fmt.Println(`calc repl, enter ":help" for a list of commands`)
+	if err := repl.Run(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// reports if f is a terminal instead of a file or a pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// prints every result on its own line
+func printResults(results []float64) {
+	for _, r := range results {
+		fmt.Printf("=> %f\n", r)
+	}
+}
+
+// flags configuring the vm, shared by all commands executing bytecode. The
+// budgets apply to the tree walk interpreter as well
+type vmFlags struct {
+	trace           *string
+	traceFile       *string
+	maxInstructions *int
+	maxCallDepth    *int
+	timeout         *time.Duration
+	tracer          Tracer // created on the first execution, shared by all following
+	traceCreated    bool
+}
+
+// registers the flags configuring the vm in fs
+func newVmFlags(fs *flag.FlagSet) *vmFlags {
+	return &vmFlags{
+		trace:           fs.String("trace", "off", "trace the operations the vm executes: 'off', 'text' or 'json' lines"),
+		traceFile:       fs.String("trace-file", "", "file to write the trace to, defaults to stderr"),
+		maxInstructions: fs.Int("max-instructions", 0, "fail after executing this many operations, or evaluating this many nodes with -backend tree, 0 for no limit"),
+		maxCallDepth:    fs.Int("max-call-depth", 0, fmt.Sprintf("fail if calls nest deeper, 0 for the default of %d", MAX_CALL_DEPTH)),
+		timeout:         fs.Duration("timeout", 0, "stop executing after this duration, e.g. 100ms, 0 for no limit"),
+	}
+}
+
+// executes code in env with the configuration of the flags
+func (f *vmFlags) execute(env *Env, code []Operation) (*Vm, error) {
+	if !f.traceCreated {
+		f.tracer, f.traceCreated = newTracer(*f.trace, *f.traceFile), true
+	}
+	vm := &Vm{
+		env:             env,
+		Trace:           f.tracer,
+		MaxInstructions: *f.maxInstructions,
+		MaxCallDepth:    *f.maxCallDepth,
+	}
+	ctx, cancel := f.context()
+	defer cancel()
+	return vm, vm.NewVmIn(code).ExecuteContext(ctx)
+}
+
+// evaluates ast with the tree walk interpreter and the budgets of the flags
+func (f *vmFlags) evaluate(env *Env, ast []Node) ([]float64, error) {
+	in := NewInterpreter(env)
+	in.MaxNodes, in.MaxCallDepth = *f.maxInstructions, *f.maxCallDepth
+	ctx, cancel := f.context()
+	defer cancel()
+	return in.EvalContext(ctx, ast)
+}
+
+// context that is done once the -timeout elapsed
+func (f *vmFlags) context() (context.Context, context.CancelFunc) {
+	if *f.timeout > 0 {
+		return context.WithTimeout(context.Background(), *f.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// creates the tracer for the -trace and -trace-file flags, nil if tracing is
+// disabled
+func newTracer(format, path string) Tracer {
+	if format == "off" {
+		return nil
+	}
+	if format != "text" && format != "json" {
+		log.Fatalf("unknown trace format %q, use 'off', 'text' or 'json'", format)
+	}
+	w := io.Writer(os.Stderr)
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		w = f
+	}
+	if format == "json" {
+		return JSONTracer(w)
+	}
+	return TextTracer(w)
+}
+
+// assembles the file at path and executes it
+func runAssembly(path string, options *vmFlags) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	program, err := Assemble(string(src))
+	if err != nil {
+		fatal(string(src), err)
+	}
+	if err := Verify(program); err != nil {
+		fatal(string(src), err)
+	}
+	env := NewEnv()
+	if err := program.Load(env); err != nil {
+		log.Fatalln(err)
+	}
+	vm, err := options.execute(env, program.Code)
+	if err != nil {
+		fatal(string(src), err)
+	}
+	printResults(vm.Results())
+}
+
+// compiles the expression to a .calcb file: calc compile [-o out.calcb] "expr"
+func compileCommand(args []string) {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	output := fs.String("o", "out.calcb", "file to write the bytecode to")
+	optimize := fs.Bool("optimize", true, "fold constant subtrees and simplify expressions before compiling")
+	peephole := fs.Bool("peephole", true, "rewrite sequences of operations to shorter ones after compiling")
+	strip := fs.Bool("strip", false, "omit the debug section containing the source and spans")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalln("missing input")
+	}
+
+	input := fs.Arg(0)
+	program, err := build(input, *optimize, *peephole)
+	if err != nil {
+		fatal(input, err)
+	}
+	if *strip {
+		program.Spans, program.Source = nil, ""
+	}
+	data, err := program.MarshalBinary()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("wrote %d bytes to %s", len(data), *output)
+}
+
+// lexes, parses and compiles input to a program with spans
+func build(input string, optimize, peephole bool) (*Program, error) {
+	token, err := NewLexer(strings.NewReader(input)).Lex()
+	if err != nil {
+		return nil, err
+	}
+	ast, err := NewParser(token).Parse()
+	if err != nil {
+		return nil, err
+	}
+	env := NewEnv()
+	if optimize {
+		ast = Optimize(env, ast)
+	}
+	compiler := NewCompiler(env)
+	compiler.Peephole = peephole
+	byteCode, err := compiler.Compile(ast)
+	if err != nil {
+		return nil, err
+	}
+	program := NewProgram(env, byteCode, compiler.Spans)
+	program.Source = input
+	return program, nil
+}
+
+// steps through the execution of the expression: calc debug "expr"
+func debugCommand(args []string) {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	optimize := fs.Bool("optimize", false, "fold constant subtrees and simplify expressions before compiling")
+	peephole := fs.Bool("peephole", false, "rewrite sequences of operations to shorter ones after compiling")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalln("missing input")
+	}
+
+	input := fs.Arg(0)
+	program, err := build(input, *optimize, *peephole)
+	if err != nil {
+		fatal(input, err)
+	}
+	debugger, err := NewDebugger(NewEnv(), program)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(`debugging, enter "help" for a list of commands`)
+	debugger.Run(os.Stdin, os.Stdout)
+}
+
+// executes a .calcb file: calc run [-disassemble] [-trace text] [-timeout 1s] file.calcb
+func runCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	disassemble := fs.Bool("disassemble", false, "print the loaded bytecode as assembly")
+	options := newVmFlags(fs)
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatalln("missing input")
+	}
+	runBytecode(fs.Arg(0), *disassemble, options)
+}
+
+// decodes the bytecode file at path and executes it
+func runBytecode(path string, disassemble bool, options *vmFlags) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	program := &Program{}
+	if err := program.UnmarshalBinary(data); err != nil {
+		log.Fatalf("%s: %s", path, err)
+	}
+	if err := Verify(program); err != nil {
+		fatal(program.Source, err)
+	}
+	env := NewEnv()
+	if err := program.Load(env); err != nil {
+		log.Fatalln(err)
+	}
+	if disassemble {
+		Disassemble(log.Writer(), program, program.Source)
+	}
+	vm, err := options.execute(env, program.Code)
+	if err != nil {
+		fatal(program.Source, err)
+	}
+	printResults(vm.Results())
 }
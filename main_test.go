@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runs main in a subprocess with args, returns its stdout and exit error
+func runMain(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestMainProcess$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "CALC_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader("")
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// executes main with the arguments after '--' if started by runMain
+func TestMainProcess(t *testing.T) {
+	if os.Getenv("CALC_TEST_MAIN") != "1" {
+		return
+	}
+	for i, arg := range os.Args {
+		if arg == "--" {
+			os.Args = append([]string{"calc"}, os.Args[i+1:]...)
+			break
+		}
+	}
+	flag.CommandLine = flag.NewFlagSet("calc", flag.ExitOnError)
+	main()
+	os.Exit(0)
+}
+
+func TestMainNegativeInput(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-2^2"}, "=> -4.000000\n"},
+		{[]string{"-7 % 3"}, "=> 2.000000\n"},
+		{[]string{"-backend", "tree", "-(-2) * 3"}, "=> 6.000000\n"},
+		{[]string{"-optimize=false", "-max-instructions", "100", "-.5"}, "=> -0.500000\n"},
+		{[]string{"-backend", "tree", "--", "-1"}, "=> -1.000000\n"},
+		{[]string{"-pi"}, "=> -3.141593\n"},
+		{[]string{"-sqrt(4)"}, "=> -2.000000\n"},
+		{[]string{"-backend", "tree", "-sqrt(4) * -pi"}, "=> 6.283185\n"},
+		{[]string{"-optimize=false", "-e"}, "=> -2.718282\n"},
+	}
+	for _, c := range cases {
+		t.Run(strings.Join(c.args, " "), func(t *testing.T) {
+			out, err := runMain(t, c.args...)
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, out)
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	optimize := fs.Bool("optimize", true, "")
+	limit := fs.Int("limit", 0, "")
+	parseFlags(fs, []string{"-optimize=false", "-limit", "-3", "-(1)", "-x"})
+	assert.False(t, *optimize)
+	assert.Equal(t, -3, *limit)
+	assert.Equal(t, []string{"-(1)", "-x"}, fs.Args())
+
+	parseFlags(fs, []string{"--limit=2", "-x", "-optimize"})
+	assert.False(t, *optimize)
+	assert.Equal(t, 2, *limit)
+	assert.Equal(t, []string{"-x", "-optimize"}, fs.Args())
+}
+
+func TestMainTreeBudgets(t *testing.T) {
+	start := time.Now()
+	_, err := runMain(t, "-backend", "tree", "-timeout", "100ms", callChain(40))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	out, err := runMain(t, "-backend", "tree", "-max-instructions", "3", "1+2")
+	assert.NoError(t, err)
+	assert.Equal(t, "=> 3.000000\n", out)
+	_, err = runMain(t, "-backend", "tree", "-optimize=false", "-max-instructions", "2", "1+2")
+	assert.Error(t, err)
+}
+
+func TestMainIgnoredFlags(t *testing.T) {
+	rejected := [][]string{
+		{"-backend", "tree", "-trace", "text", "1+2"},
+		{"-backend", "tree", "-trace-file", "trace.txt", "1+2"},
+		{"-backend", "tree", "-disassemble", "1+2"},
+		{"-backend", "tree", "-peephole=false", "1+2"},
+		{"-optimize=false", "-show-optimized", "1+2"},
+		{"-disassemble", "-f", "-"},
+		{"-f", "-", "1+2"},
+		{"-show-optimized", "-"},
+		{"-backend", "tree", "examples/double.casm"},
+	}
+	for _, args := range rejected {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			_, err := runMain(t, args...)
+			assert.Error(t, err)
+		})
+	}
+
+	accepted := [][]string{
+		{"-backend", "tree", "-trace", "off", "-peephole=true", "1+2"},
+		{"-show-optimized", "1+2"},
+		{"-disassemble", "-optimize=false", "1+2"},
+	}
+	for _, args := range accepted {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			out, err := runMain(t, args...)
+			assert.NoError(t, err)
+			assert.Equal(t, "=> 3.000000\n", out)
+		})
+	}
+}
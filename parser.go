@@ -1,19 +1,29 @@
 package main
 
 import (
-	"log"
+	"fmt"
 )
 
 // Grammar:
+// statement  ::= IDENT '=' expression | function | expression
+// function   ::= IDENT '(' ( IDENT ( ',' IDENT ) * ) ? ')' '=' expression
 // expression ::= term
 // term       ::= factor ( ( '+' | '-' ) factor ) *
-// factor     ::= unary ( ( '*' | '/' ) unary ) *
-// unary      ::= ('-') unary | primary
-// primary    ::= NUMBER | '(' expression ')'
+// factor     ::= unary ( ( '*' | '/' | '//' | '%' ) unary ) *
+// unary      ::= ('-') unary | power
+// power      ::= primary ( ( '^' | '**' ) unary ) ?
+// primary    ::= NUMBER | call | IDENT | '(' expression ')'
+// call       ::= IDENT '(' ( expression ( ',' expression ) * ) ? ')'
+//
+// A line break ends a statement, unless it is inside parentheses: '3 +\n4' is
+// an error, 'max(3,\n4)' a single statement. The '(' of a call has to be on
+// the line of the name, 'x\n(3)' are two statements.
 
 type Parser struct {
 	token []Token
 	pos   int
+	start int // position of the first token of the current statement
+	depth int // amount of open parentheses in the current statement
 }
 
 func NewParser(token []Token) *Parser {
@@ -24,71 +34,272 @@ func NewParser(token []Token) *Parser {
 	return p
 }
 
-func (p *Parser) Parse() []Node {
+// parses all statements in the token stream. If the token stream does not
+// match the grammar the parser records a *ParseError, skips to the next line
+// and continues parsing. Returns the statements that parsed and an ErrorList
+// containing all syntax errors
+func (p *Parser) Parse() ([]Node, error) {
 	o := make([]Node, 0)
-	for !p.atEnd() {
-		o = append(o, p.expression())
+	errs := ErrorList{}
+	failed := -1
+	for p.token[p.pos].Type != TOKEN_EOF {
+		p.start, p.depth = p.pos, 0
+		node, err := p.statement()
+		if err != nil {
+			// the token the parser failed at can be the first token of the
+			// next expression, in that case it fails there again
+			if p.pos != failed {
+				errs = append(errs, err)
+			}
+			failed = p.pos
+			p.synchronize()
+			continue
+		}
+		o = append(o, node)
+	}
+	if len(errs) > 0 {
+		return o, errs
+	}
+	return o, nil
+}
+
+// skips tokens until the first token on a line after the token the parser
+// failed at, discarding the remainder of a failed statement. Skips nothing if
+// the statement failed at the first token of a later line, such as the line
+// after an unclosed '(', parsing continues there
+func (p *Parser) synchronize() {
+	t := p.token[p.pos]
+	if p.pos > p.start && t.Span.Start.Line > p.previous().Span.End.Line {
+		return
+	}
+	line := t.Span.Start.Line
+	for p.token[p.pos].Type != TOKEN_EOF && p.token[p.pos].Span.Start.Line <= line {
+		p.pos++
+	}
+}
+
+func (p *Parser) statement() (Node, error) {
+	if p.check(TOKEN_IDENT) && p.followedBy(TOKEN_EQUAL) {
+		name := p.advance()
+		p.advance()
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &Assign{token: name, value: value, span: p.spanFrom(name.Span.Start)}, nil
+	}
+
+	node, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	// a function definition starts like a call, the '=' after the call
+	// turns it into the head of a definition
+	if call, ok := node.(*Call); ok && p.match(TOKEN_EQUAL) {
+		return p.function(call)
 	}
-	return o
+	return node, nil
 }
 
-func (p *Parser) expression() Node {
+// converts the call to the head of a function definition, parses the body
+func (p *Parser) function(call *Call) (Node, error) {
+	params := make([]Token, len(call.args))
+	seen := make(map[string]Span, len(call.args))
+	for i, arg := range call.args {
+		ident, ok := arg.(*Ident)
+		if !ok {
+			return nil, &ParseError{
+				Token: Token{Type: TOKEN_UNKNOWN, Span: arg.Span()},
+				Code:  CODE_INVALID_PARAMETER,
+				Msg:   fmt.Sprintf("invalid parameter of %s, parameters have to be names", call.token.Raw),
+				Note:  "expected a name",
+			}
+		}
+		if first, ok := seen[ident.token.Raw]; ok {
+			return nil, &ParseError{
+				Token:  ident.token,
+				Code:   CODE_INVALID_PARAMETER,
+				Msg:    fmt.Sprintf("duplicate parameter %q of %s", ident.token.Raw, call.token.Raw),
+				Note:   "declared again",
+				Labels: []Label{{Span: first, Msg: "first declared here"}},
+			}
+		}
+		seen[ident.token.Raw] = ident.token.Span
+		params[i] = ident.token
+	}
+
+	body, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &FuncDef{
+		token:  call.token,
+		params: params,
+		body:   body,
+		span:   p.spanFrom(call.span.Start),
+	}, nil
+}
+
+func (p *Parser) expression() (Node, error) {
 	return p.term()
 }
 
-func (p *Parser) term() Node {
-	lhs := p.factor()
+func (p *Parser) term() (Node, error) {
+	start := p.peek().Span.Start
+	lhs, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
 
 	for p.match(TOKEN_MINUS, TOKEN_PLUS) {
 		op := p.previous()
-		rhs := p.factor()
+		rhs, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
 		lhs = &Binary{
 			token: op,
 			left:  lhs,
 			right: rhs,
+			span:  p.spanFrom(start),
 		}
 	}
 
-	return lhs
+	return lhs, nil
 }
 
-func (p *Parser) factor() Node {
-	lhs := p.unary()
+func (p *Parser) factor() (Node, error) {
+	start := p.peek().Span.Start
+	lhs, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
 
-	for p.match(TOKEN_SLASH, TOKEN_ASTERISK) {
+	for p.match(TOKEN_SLASH, TOKEN_ASTERISK, TOKEN_DOUBLE_SLASH, TOKEN_PERCENT) {
 		op := p.previous()
-		rhs := p.unary()
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
 		lhs = &Binary{
 			token: op,
 			left:  lhs,
 			right: rhs,
+			span:  p.spanFrom(start),
 		}
 	}
 
-	return lhs
+	return lhs, nil
 }
 
-func (p *Parser) unary() Node {
+func (p *Parser) unary() (Node, error) {
 	if p.match(TOKEN_MINUS) {
 		op := p.previous()
-		right := p.unary()
-		return &Unary{token: op, right: right}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{token: op, right: right, span: p.spanFrom(op.Span.Start)}, nil
+	}
+
+	return p.power()
+}
+
+// the exponent is parsed by unary, which recurses into power again, this makes
+// '^' right associative (2^3^2 == 2^(3^2)) and allows a negative exponent
+// (2^-1), while the unary minus in front of the base binds weaker (-2^2 ==
+// -(2^2))
+func (p *Parser) power() (Node, error) {
+	start := p.peek().Span.Start
+	lhs, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.match(TOKEN_CARET) {
+		op := p.previous()
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{
+			token: op,
+			left:  lhs,
+			right: rhs,
+			span:  p.spanFrom(start),
+		}
 	}
 
-	return p.primary()
+	return lhs, nil
 }
 
-func (p *Parser) primary() Node {
+func (p *Parser) primary() (Node, error) {
 	if p.match(TOKEN_NUMBER) {
 		op := p.previous()
-		return &Number{token: op}
+		return &Number{token: op}, nil
+	} else if p.check(TOKEN_IDENT) && p.followedBy(TOKEN_BRACE_LEFT) {
+		return p.call()
+	} else if p.match(TOKEN_IDENT) {
+		return &Ident{token: p.previous()}, nil
 	} else if p.match(TOKEN_BRACE_LEFT) {
-		node := p.expression()
-		p.consume(TOKEN_BRACE_RIGHT, "Expected '('")
-		return node
+		open := p.previous()
+		p.depth++
+		node, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.consume(TOKEN_BRACE_RIGHT, "')' to close group"); err != nil {
+			err.Code = CODE_UNCLOSED_BRACE
+			err.Note = "expected ')'"
+			err.Labels = []Label{{Span: open.Span, Msg: "unclosed parenthesis opened here"}}
+			err.Hint = "add a ')' after the expression"
+			return nil, err
+		}
+		p.depth--
+		return node, nil
+	} else if p.check(TOKEN_BRACE_RIGHT) {
+		return nil, &ParseError{
+			Token: p.peek(),
+			Code:  CODE_UNMATCHED_BRACE,
+			Msg:   "unmatched ')'",
+			Note:  "no '(' to close",
+			Hint:  "remove the ')' or add a matching '('",
+		}
 	}
 
-	panic("Expected expression")
+	return nil, &ParseError{
+		Token: p.peek(),
+		Code:  CODE_EXPECTED_EXPRESSION,
+		Msg:   fmt.Sprintf("expected expression, got %s", describe(p.peek())),
+		Note:  "expected a number, a variable, '-' or '('",
+	}
+}
+
+func (p *Parser) call() (Node, error) {
+	name := p.advance()
+	open := p.advance()
+	p.depth++
+	args := make([]Node, 0)
+	if !p.check(TOKEN_BRACE_RIGHT) {
+		for {
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	if err := p.consume(TOKEN_BRACE_RIGHT, "')' to close the argument list"); err != nil {
+		err.Code = CODE_UNCLOSED_BRACE
+		err.Note = "expected ',' or ')'"
+		err.Labels = []Label{{Span: open.Span, Msg: "argument list opened here"}}
+		return nil, err
+	}
+	p.depth--
+	return &Call{token: name, args: args, span: p.spanFrom(name.Span.Start)}, nil
 }
 
 func (p *Parser) match(tokenTypes ...int) bool {
@@ -101,12 +312,30 @@ func (p *Parser) match(tokenTypes ...int) bool {
 	return false
 }
 
-func (p *Parser) consume(tokenType int, error string) {
+// advances if the current token is of tokenType, otherwise returns a
+// *ParseError describing what was expected
+func (p *Parser) consume(tokenType int, expected string) *ParseError {
 	if p.check(tokenType) {
 		p.advance()
-		return
+		return nil
+	}
+	return &ParseError{
+		Token: p.peek(),
+		Code:  CODE_UNEXPECTED_TOKEN,
+		Msg:   fmt.Sprintf("expected %s, got %s", expected, describe(p.peek())),
+		Note:  fmt.Sprintf("expected %s", TOKEN_LOOKUP[tokenType]),
+	}
+}
+
+// human readable description of a token for error messages
+func describe(t Token) string {
+	switch t.Type {
+	case TOKEN_EOF:
+		return "end of input"
+	case TOKEN_NEWLINE:
+		return "end of line"
 	}
-	log.Panicf("Wanted %q, got %q: %s", TOKEN_LOOKUP[p.peek().Type], TOKEN_LOOKUP[tokenType], error)
+	return fmt.Sprintf("%q", t.Raw)
 }
 
 func (p *Parser) check(tokenType int) bool {
@@ -123,14 +352,38 @@ func (p *Parser) advance() Token {
 	return p.previous()
 }
 
+// reports if the input or the current statement ended
 func (p *Parser) atEnd() bool {
-	return p.peek().Type == TOKEN_EOF
+	t := p.peek().Type
+	return t == TOKEN_EOF || t == TOKEN_NEWLINE
 }
 
+// returns the current token, a TOKEN_NEWLINE after the last token of the
+// statement if the current token is on a later line outside of parentheses
 func (p *Parser) peek() Token {
-	return p.token[p.pos]
+	t := p.token[p.pos]
+	if p.depth == 0 && p.pos > p.start && t.Type != TOKEN_EOF && t.Span.Start.Line > p.previous().Span.End.Line {
+		end := p.previous().Span.End
+		return Token{Type: TOKEN_NEWLINE, Raw: "\n", Span: Span{Start: end, End: end}}
+	}
+	return t
+}
+
+// reports if the token after the current one is of tokenType and starts on
+// the line the current one ends on
+func (p *Parser) followedBy(tokenType int) bool {
+	if p.pos+1 >= len(p.token) {
+		return false
+	}
+	next := p.token[p.pos+1]
+	return next.Type == tokenType && next.Span.Start.Line == p.token[p.pos].Span.End.Line
 }
 
 func (p *Parser) previous() Token {
 	return p.token[p.pos-1]
 }
+
+// span from start to the end of the previously consumed token
+func (p *Parser) spanFrom(start Position) Span {
+	return Span{Start: start, End: p.previous().Span.End}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,70 +16,357 @@ func TestParser(t *testing.T) {
 	}{
 		{
 			Name: "Empty input",
-			In:   []Token{{TOKEN_EOF, "TOKEN_EOF"}},
+			In:   []Token{{Type: TOKEN_EOF, Raw: "TOKEN_EOF"}},
 			Out:  []Node{},
 		},
 		{
 			Name: "Addition",
 			In: []Token{
-				{TOKEN_NUMBER, "5"},
-				{TOKEN_PLUS, "+"},
-				{TOKEN_NUMBER, "1"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{Type: TOKEN_NUMBER, Raw: "5"},
+				{Type: TOKEN_PLUS, Raw: "+"},
+				{Type: TOKEN_NUMBER, Raw: "1"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
 			},
 			Out: []Node{&Binary{
-				token: Token{TOKEN_PLUS, "+"},
-				left:  &Number{token: Token{TOKEN_NUMBER, "5"}},
-				right: &Number{token: Token{TOKEN_NUMBER, "1"}},
+				token: Token{Type: TOKEN_PLUS, Raw: "+"},
+				left:  &Number{token: Token{Type: TOKEN_NUMBER, Raw: "5"}},
+				right: &Number{token: Token{Type: TOKEN_NUMBER, Raw: "1"}},
 			}},
 		},
 		{
 			Name: "Subtraction",
 			In: []Token{
-				{TOKEN_NUMBER, "5"},
-				{TOKEN_MINUS, "-"},
-				{TOKEN_NUMBER, "1"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{Type: TOKEN_NUMBER, Raw: "5"},
+				{Type: TOKEN_MINUS, Raw: "-"},
+				{Type: TOKEN_NUMBER, Raw: "1"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
 			},
 			Out: []Node{&Binary{
-				token: Token{TOKEN_MINUS, "-"},
-				left:  &Number{token: Token{TOKEN_NUMBER, "5"}},
-				right: &Number{token: Token{TOKEN_NUMBER, "1"}},
+				token: Token{Type: TOKEN_MINUS, Raw: "-"},
+				left:  &Number{token: Token{Type: TOKEN_NUMBER, Raw: "5"}},
+				right: &Number{token: Token{Type: TOKEN_NUMBER, Raw: "1"}},
 			}},
 		},
 		{
 			Name: "Multiplication",
 			In: []Token{
-				{TOKEN_NUMBER, "5"},
-				{TOKEN_ASTERISK, "*"},
-				{TOKEN_NUMBER, "1"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{Type: TOKEN_NUMBER, Raw: "5"},
+				{Type: TOKEN_ASTERISK, Raw: "*"},
+				{Type: TOKEN_NUMBER, Raw: "1"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
 			},
 			Out: []Node{&Binary{
-				token: Token{TOKEN_ASTERISK, "*"},
-				left:  &Number{token: Token{TOKEN_NUMBER, "5"}},
-				right: &Number{token: Token{TOKEN_NUMBER, "1"}},
+				token: Token{Type: TOKEN_ASTERISK, Raw: "*"},
+				left:  &Number{token: Token{Type: TOKEN_NUMBER, Raw: "5"}},
+				right: &Number{token: Token{Type: TOKEN_NUMBER, Raw: "1"}},
 			}},
 		},
 		{
 			Name: "Division",
 			In: []Token{
-				{TOKEN_NUMBER, "5"},
-				{TOKEN_SLASH, "/"},
-				{TOKEN_NUMBER, "1"},
-				{TOKEN_EOF, "TOKEN_EOF"},
+				{Type: TOKEN_NUMBER, Raw: "5"},
+				{Type: TOKEN_SLASH, Raw: "/"},
+				{Type: TOKEN_NUMBER, Raw: "1"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
 			},
 			Out: []Node{&Binary{
-				token: Token{TOKEN_SLASH, "/"},
-				left:  &Number{token: Token{TOKEN_NUMBER, "5"}},
-				right: &Number{token: Token{TOKEN_NUMBER, "1"}},
+				token: Token{Type: TOKEN_SLASH, Raw: "/"},
+				left:  &Number{token: Token{Type: TOKEN_NUMBER, Raw: "5"}},
+				right: &Number{token: Token{Type: TOKEN_NUMBER, Raw: "1"}},
+			}},
+		},
+		{
+			Name: "Assignment",
+			In: []Token{
+				{Type: TOKEN_IDENT, Raw: "x"},
+				{Type: TOKEN_EQUAL, Raw: "="},
+				{Type: TOKEN_IDENT, Raw: "y"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+			},
+			Out: []Node{&Assign{
+				token: Token{Type: TOKEN_IDENT, Raw: "x"},
+				value: &Ident{token: Token{Type: TOKEN_IDENT, Raw: "y"}},
+			}},
+		},
+		{
+			Name: "Call",
+			In: []Token{
+				{Type: TOKEN_IDENT, Raw: "max"},
+				{Type: TOKEN_BRACE_LEFT, Raw: "("},
+				{Type: TOKEN_NUMBER, Raw: "1"},
+				{Type: TOKEN_COMMA, Raw: ","},
+				{Type: TOKEN_IDENT, Raw: "x"},
+				{Type: TOKEN_BRACE_RIGHT, Raw: ")"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+			},
+			Out: []Node{&Call{
+				token: Token{Type: TOKEN_IDENT, Raw: "max"},
+				args: []Node{
+					&Number{token: Token{Type: TOKEN_NUMBER, Raw: "1"}},
+					&Ident{token: Token{Type: TOKEN_IDENT, Raw: "x"}},
+				},
+			}},
+		},
+		{
+			Name: "Call without arguments",
+			In: []Token{
+				{Type: TOKEN_IDENT, Raw: "f"},
+				{Type: TOKEN_BRACE_LEFT, Raw: "("},
+				{Type: TOKEN_BRACE_RIGHT, Raw: ")"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+			},
+			Out: []Node{&Call{
+				token: Token{Type: TOKEN_IDENT, Raw: "f"},
+				args:  []Node{},
 			}},
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			out := NewParser(test.In).Parse()
+			out, err := NewParser(test.In).Parse()
+			assert.NoError(t, err)
 			assert.EqualValues(t, test.Out, out)
 		})
 	}
 }
+
+func TestParserPrecedence(t *testing.T) {
+	tests := []struct {
+		In  string
+		Out string
+	}{
+		{In: "2^3^2", Out: "(2 ^ (3 ^ 2))"},
+		{In: "2**3**2", Out: "(2 ** (3 ** 2))"},
+		{In: "-2^2", Out: "(-(2 ^ 2))"},
+		{In: "2^-1", Out: "(2 ^ (-1))"},
+		{In: "2*3^2", Out: "(2 * (3 ^ 2))"},
+		{In: "(2*3)^2", Out: "((2 * 3) ^ 2)"},
+		{In: "1+2*3-4", Out: "((1 + (2 * 3)) - 4)"},
+		{In: "7%3*2//4", Out: "(((7 % 3) * 2) // 4)"},
+		{In: "1+7%-3", Out: "(1 + (7 % (-3)))"},
+	}
+	for _, test := range tests {
+		t.Run(test.In, func(t *testing.T) {
+			token, err := NewLexer(strings.NewReader(test.In)).Lex()
+			assert.NoError(t, err)
+			ast, err := NewParser(token).Parse()
+			assert.NoError(t, err)
+			assert.Len(t, ast, 1)
+			assert.Equal(t, test.Out, parenthesize(ast[0]))
+		})
+	}
+}
+
+// renders the tree with explicit parenthesis around every operation
+func parenthesize(n Node) string {
+	switch n := n.(type) {
+	case *Binary:
+		return fmt.Sprintf("(%s %s %s)", parenthesize(n.left), n.token.Raw, parenthesize(n.right))
+	case *Unary:
+		return fmt.Sprintf("(-%s)", parenthesize(n.right))
+	case *Number:
+		return n.token.Raw
+	case *Ident:
+		return n.token.Raw
+	}
+	return "?"
+}
+
+func TestParserErrors(t *testing.T) {
+	tests := []struct {
+		Name  string
+		In    []Token
+		Token Token
+	}{
+		{
+			Name: "missing operand",
+			In: []Token{
+				{Type: TOKEN_NUMBER, Raw: "5"},
+				{Type: TOKEN_PLUS, Raw: "+"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+			},
+			Token: Token{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+		},
+		{
+			Name: "unclosed brace",
+			In: []Token{
+				{Type: TOKEN_BRACE_LEFT, Raw: "("},
+				{Type: TOKEN_NUMBER, Raw: "5"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+			},
+			Token: Token{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+		},
+		{
+			Name: "assignment to number",
+			In: []Token{
+				{Type: TOKEN_NUMBER, Raw: "1"},
+				{Type: TOKEN_EQUAL, Raw: "="},
+				{Type: TOKEN_NUMBER, Raw: "2"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+			},
+			Token: Token{Type: TOKEN_EQUAL, Raw: "="},
+		},
+		{
+			Name: "unclosed argument list",
+			In: []Token{
+				{Type: TOKEN_IDENT, Raw: "max"},
+				{Type: TOKEN_BRACE_LEFT, Raw: "("},
+				{Type: TOKEN_NUMBER, Raw: "1"},
+				{Type: TOKEN_NUMBER, Raw: "2"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+			},
+			Token: Token{Type: TOKEN_NUMBER, Raw: "2"},
+		},
+		{
+			Name: "unexpected closing brace",
+			In: []Token{
+				{Type: TOKEN_BRACE_RIGHT, Raw: ")"},
+				{Type: TOKEN_EOF, Raw: "TOKEN_EOF"},
+			},
+			Token: Token{Type: TOKEN_BRACE_RIGHT, Raw: ")"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := NewParser(test.In).Parse()
+			var parseErr *ParseError
+			if assert.ErrorAs(t, err, &parseErr) {
+				assert.Equal(t, test.Token, parseErr.Token)
+			}
+		})
+	}
+}
+
+func TestParserSpans(t *testing.T) {
+	token, err := NewLexer(strings.NewReader("(1+2) * -3")).Lex()
+	assert.NoError(t, err)
+	ast, err := NewParser(token).Parse()
+	assert.NoError(t, err)
+	assert.Len(t, ast, 1)
+
+	mul := ast[0].(*Binary)
+	assert.Equal(t, span(1, 1, 0, 10), mul.Span())
+	assert.Equal(t, span(1, 2, 1, 4), mul.left.Span())
+	assert.Equal(t, span(1, 9, 8, 10), mul.right.Span())
+	assert.Equal(t, span(1, 10, 9, 10), mul.right.(*Unary).right.Span())
+}
+
+func TestParserRecovery(t *testing.T) {
+	tests := []struct {
+		Name   string
+		In     string
+		Nodes  int
+		Errors []string
+	}{
+		{
+			Name:   "error on every line",
+			In:     "1 + * 2\n* 2\n(3",
+			Nodes:  0,
+			Errors: []string{CODE_EXPECTED_EXPRESSION, CODE_EXPECTED_EXPRESSION, CODE_UNCLOSED_BRACE},
+		},
+		{
+			Name:   "valid lines are kept",
+			In:     "1+1\n2 * * 3\n3/3\n)\n4",
+			Nodes:  3,
+			Errors: []string{CODE_EXPECTED_EXPRESSION, CODE_UNMATCHED_BRACE},
+		},
+		{
+			Name:   "failed token starts the next expression",
+			In:     "(1+2\n3+4",
+			Nodes:  1,
+			Errors: []string{CODE_UNCLOSED_BRACE},
+		},
+		{
+			Name:   "line break ends a statement",
+			In:     "3 +\n4",
+			Nodes:  1,
+			Errors: []string{CODE_EXPECTED_EXPRESSION},
+		},
+		{
+			Name:   "failed token is not reported twice",
+			In:     "1 +\n* 2\n5",
+			Nodes:  1,
+			Errors: []string{CODE_EXPECTED_EXPRESSION},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			token, err := NewLexer(strings.NewReader(test.In)).Lex()
+			assert.NoError(t, err)
+			ast, err := NewParser(token).Parse()
+			assert.Len(t, ast, test.Nodes)
+
+			var list ErrorList
+			if assert.ErrorAs(t, err, &list) {
+				codes := make([]string, len(list))
+				for i, e := range list {
+					codes[i] = e.(*ParseError).Code
+				}
+				assert.Equal(t, test.Errors, codes)
+			}
+		})
+	}
+}
+
+func TestParserFunctions(t *testing.T) {
+	token, err := NewLexer(strings.NewReader("f(x, y) = x + y")).Lex()
+	assert.NoError(t, err)
+	ast, err := NewParser(token).Parse()
+	assert.NoError(t, err)
+	if assert.Len(t, ast, 1) {
+		def, ok := ast[0].(*FuncDef)
+		if assert.True(t, ok) {
+			assert.Equal(t, "f", def.token.Raw)
+			assert.Equal(t, []Token{
+				{TOKEN_IDENT, "x", span(1, 3, 2, 3)},
+				{TOKEN_IDENT, "y", span(1, 6, 5, 6)},
+			}, def.params)
+			assert.Equal(t, "(x + y)", parenthesize(def.body))
+			assert.Equal(t, span(1, 1, 0, 15), def.Span())
+		}
+	}
+
+	for _, in := range []string{"f(1) = 2", "f(x, x) = x", "f(x + 1) = x"} {
+		t.Run(in, func(t *testing.T) {
+			token, err := NewLexer(strings.NewReader(in)).Lex()
+			assert.NoError(t, err)
+			_, err = NewParser(token).Parse()
+			var parseErr *ParseError
+			if assert.ErrorAs(t, err, &parseErr) {
+				assert.Equal(t, CODE_INVALID_PARAMETER, parseErr.Code)
+			}
+		})
+	}
+}
+
+func TestParserLineBreaks(t *testing.T) {
+	tests := []struct {
+		In   string
+		Want []string
+	}{
+		{"x = 2\nx\n(3)", []string{"=\n  x\n  2", "x", "3"}},
+		{"f(a) = a + pi\n(-1)", []string{"f(a) =\n  +\n    a\n    pi", "/\n - 1"}},
+		{"max(3,\n4) +\n(5)", nil},
+		{"(1\n+ 2) * 3", []string{"*\n  +\n    1\n    2\n  3"}},
+		{"max(1,\n2) + 3", []string{"+\n  max()\n    1\n    2\n  3"}},
+		{"x\n= 2", nil},
+		{"1 2\n3", []string{"1", "2", "3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.In, func(t *testing.T) {
+			token, err := NewLexer(strings.NewReader(test.In)).Lex()
+			assert.NoError(t, err)
+			ast, err := NewParser(token).Parse()
+			if test.Want == nil {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			got := make([]string, len(ast))
+			for i, n := range ast {
+				got[i] = strings.TrimSpace(n.String(0))
+			}
+			assert.Equal(t, test.Want, got)
+		})
+	}
+}
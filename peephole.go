@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// matches a single operation of a peephole pattern
+type match func(o Operation) bool
+
+func is(code OpCode) match {
+	return func(o Operation) bool { return o.Code == code }
+}
+
+// arithmetic operation with a register operand
+func registerOp(o Operation) bool {
+	op, ok := ARITHMETIC[o.Code]
+	return ok && !op.immediate
+}
+
+// arithmetic operation with an immediate operand
+func immediateOp(o Operation) bool {
+	op, ok := ARITHMETIC[o.Code]
+	return ok && op.immediate
+}
+
+// loads a variable or parameter into register 0 without touching other
+// registers
+func loadsVariable(o Operation) bool {
+	return o.Code == OP_LOAD_GLOBAL || o.Code == OP_LOAD_LOCAL
+}
+
+// returns the arithmetic operation with the same base operation as code,
+// operands swapped if reversed is set, taking an immediate operand
+func immediate(code OpCode, reversed bool) OpCode {
+	op := ARITHMETIC[code]
+	if reversed {
+		op.reversed = !op.reversed
+	}
+	// there are no reversed forms of commutative operations
+	if op.base == OP_ADD || op.base == OP_MULTIPY {
+		op.reversed = false
+	}
+	op.immediate = true
+	for c, o := range ARITHMETIC {
+		if o == op {
+			return c
+		}
+	}
+	panic(fmt.Sprintf("no immediate form of %s", OP_LOOKUP[code]))
+}
+
+// replaces a sequence of operations matching pattern by the result of
+// rewrite, if rewrite accepts the operations. Rewrites have to emit less
+// operations than they replace
+type rule struct {
+	name    string
+	pattern []match
+	rewrite func(o []Operation) ([]Operation, bool)
+}
+
+// rules of the peephole optimizer, they rely on the compiler never reading
+// a register after the arithmetic operation consuming it
+var PEEPHOLE_RULES = []rule{
+	{
+		// OP_NOP
+		name:    "no operation",
+		pattern: []match{is(OP_NOP)},
+		rewrite: func(o []Operation) ([]Operation, bool) {
+			return nil, true
+		},
+	},
+	{
+		// OP_NEG; OP_NEG
+		name:    "double negation",
+		pattern: []match{is(OP_NEG), is(OP_NEG)},
+		rewrite: func(o []Operation) ([]Operation, bool) {
+			return nil, true
+		},
+	},
+	{
+		// OP_LOAD c; OP_NEG -> OP_LOAD -c
+		name:    "negated constant",
+		pattern: []match{is(OP_LOAD), is(OP_NEG)},
+		rewrite: func(o []Operation) ([]Operation, bool) {
+			return []Operation{{OP_LOAD, -o[0].Arg}}, true
+		},
+	},
+	{
+		// OP_STORE r; OP_LOAD c; OP_SUBTRACT r -> OP_RSUBTRACTI c
+		name:    "immediate right operand",
+		pattern: []match{is(OP_STORE), is(OP_LOAD), registerOp},
+		rewrite: func(o []Operation) ([]Operation, bool) {
+			if o[0].Arg != o[2].Arg {
+				return nil, false
+			}
+			// the value of register 0 takes the place of the register
+			return []Operation{{immediate(o[2].Code, true), o[1].Arg}}, true
+		},
+	},
+	{
+		// OP_LOAD c; OP_STORE r; OP_LOAD_GLOBAL s; OP_SUBTRACT r -> OP_LOAD_GLOBAL s; OP_SUBTRACTI c
+		name:    "immediate left operand",
+		pattern: []match{is(OP_LOAD), is(OP_STORE), loadsVariable, registerOp},
+		rewrite: func(o []Operation) ([]Operation, bool) {
+			if o[1].Arg != o[3].Arg {
+				return nil, false
+			}
+			return []Operation{o[2], {immediate(o[3].Code, false), o[0].Arg}}, true
+		},
+	},
+	{
+		// OP_LOAD c; OP_ADDI d -> OP_LOAD d+c
+		name:    "constant immediate",
+		pattern: []match{is(OP_LOAD), immediateOp},
+		rewrite: func(o []Operation) ([]Operation, bool) {
+			return []Operation{{OP_LOAD, compute(o[1].Code, o[1].Arg, o[0].Arg)}}, true
+		},
+	},
+	{
+		// OP_STORE_GLOBAL s; OP_LOAD_GLOBAL s -> OP_STORE_GLOBAL s
+		name:    "reload of stored variable",
+		pattern: []match{is(OP_STORE_GLOBAL), is(OP_LOAD_GLOBAL)},
+		rewrite: func(o []Operation) ([]Operation, bool) {
+			return []Operation{o[0]}, o[0].Arg == o[1].Arg
+		},
+	},
+	{
+		// OP_STORE_GLOBAL s; OP_RESULT; OP_LOAD_GLOBAL s -> OP_STORE_GLOBAL s; OP_RESULT
+		name:    "reload of emitted variable",
+		pattern: []match{is(OP_STORE_GLOBAL), is(OP_RESULT), is(OP_LOAD_GLOBAL)},
+		rewrite: func(o []Operation) ([]Operation, bool) {
+			return o[:2], o[0].Arg == o[2].Arg
+		},
+	},
+}
+
+// longest pattern in PEEPHOLE_RULES
+var peepholeWindow = func() int {
+	longest := 0
+	for _, r := range PEEPHOLE_RULES {
+		if len(r.pattern) > longest {
+			longest = len(r.pattern)
+		}
+	}
+	return longest
+}()
+
+// summary of a peephole optimization
+type PeepholeReport struct {
+	Before  int            // amount of operations before optimizing
+	After   int            // amount of operations after optimizing
+	Applied map[string]int // amount of rewrites by rule name
+}
+
+// adds the counts of other to the report
+func (r *PeepholeReport) add(other PeepholeReport) {
+	if r.Applied == nil {
+		r.Applied = make(map[string]int)
+	}
+	r.Before += other.Before
+	r.After += other.After
+	for name, count := range other.Applied {
+		r.Applied[name] += count
+	}
+}
+
+// amount of operations the optimizer removed
+func (r PeepholeReport) Eliminated() int {
+	return r.Before - r.After
+}
+
+// formats the report as 'eliminated 3 of 10 operations (rule: count, ...)',
+// rules in the order of PEEPHOLE_RULES
+func (r PeepholeReport) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "eliminated %d of %d operations", r.Eliminated(), r.Before)
+	applied := make([]string, 0, len(r.Applied))
+	for _, rule := range PEEPHOLE_RULES {
+		if count := r.Applied[rule.name]; count > 0 {
+			applied = append(applied, fmt.Sprintf("%s: %d", rule.name, count))
+		}
+	}
+	if len(applied) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(applied, ", "))
+	}
+	return b.String()
+}
+
+// locations of the replacement of the window of operations: operations kept
+// from the window keep their location, new operations take the location of
+// the last operations of the window
+func rewrittenSpans(window []Operation, spans []Span, replacement []Operation) []Span {
+	o := make([]Span, len(replacement))
+	for i, op := range replacement {
+		o[i] = spans[len(spans)-len(replacement)+i]
+		for j := len(window) - 1; j >= 0; j-- {
+			if window[j] == op {
+				o[i] = spans[j]
+				break
+			}
+		}
+	}
+	return o
+}
+
+// matches the pattern of the rule against the end of o, returns the
+// rewritten operations and how many operations at the end of o they replace
+func (r rule) apply(o []Operation) ([]Operation, int, bool) {
+	n := len(r.pattern)
+	if len(o) < n {
+		return nil, 0, false
+	}
+	window := o[len(o)-n:]
+	for i, m := range r.pattern {
+		if !m(window[i]) {
+			return nil, 0, false
+		}
+	}
+	replacement, ok := r.rewrite(window)
+	return replacement, n, ok
+}
+
+// optimizes the operations by rewriting short sequences according to
+// PEEPHOLE_RULES until no rule matches. The input is not modified
+func Peephole(ops []Operation) ([]Operation, PeepholeReport) {
+	out, _, report := peephole(ops, nil)
+	return out, report
+}
+
+// like Peephole, keeps spans in line with the operations if spans contains
+// the location of each operation. Rewritten operations take the locations of
+// the last operations they replace
+func peephole(ops []Operation, spans []Span) ([]Operation, []Span, PeepholeReport) {
+	report := PeepholeReport{Before: len(ops), Applied: make(map[string]int)}
+	track := len(spans) == len(ops)
+	out := make([]Operation, 0, len(ops))
+	outSpans := make([]Span, 0, len(spans))
+	pendingSpans := make([]Span, 0)
+	// the operations are appended to the output one after another, the
+	// rules are matched against the end of the output. Rewritten operations
+	// are appended again, so they can complete further patterns
+	pending := make([]Operation, 0)
+	for i := 0; i < len(ops) || len(pending) > 0; {
+		if len(pending) > 0 {
+			out = append(out, pending[0])
+			pending = pending[1:]
+			if track {
+				outSpans = append(outSpans, pendingSpans[0])
+				pendingSpans = pendingSpans[1:]
+			}
+		} else {
+			out = append(out, ops[i])
+			if track {
+				outSpans = append(outSpans, spans[i])
+			}
+			i++
+		}
+		for _, r := range PEEPHOLE_RULES {
+			replacement, n, ok := r.apply(out)
+			if !ok {
+				continue
+			}
+			if track {
+				rewritten := rewrittenSpans(out[len(out)-n:], outSpans[len(outSpans)-n:], replacement)
+				pendingSpans = append(rewritten, pendingSpans...)
+				outSpans = outSpans[:len(outSpans)-n]
+			}
+			out = out[:len(out)-n]
+			pending = append(replacement, pending...)
+			report.Applied[r.name]++
+			break
+		}
+	}
+	report.After = len(out)
+	if !track {
+		outSpans = nil
+	}
+	return out, outSpans, report
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []Operation
+		out     []Operation
+		applied map[string]int
+	}{
+		{
+			name:    "no operation",
+			in:      []Operation{{OP_NOP, 0}, {OP_LOAD, 1}, {OP_NOP, 0}},
+			out:     []Operation{{OP_LOAD, 1}},
+			applied: map[string]int{"no operation": 2},
+		},
+		{
+			name:    "double negation",
+			in:      []Operation{{OP_LOAD_GLOBAL, 0}, {OP_NEG, 0}, {OP_NEG, 0}, {OP_NEG, 0}},
+			out:     []Operation{{OP_LOAD_GLOBAL, 0}, {OP_NEG, 0}},
+			applied: map[string]int{"double negation": 1},
+		},
+		{
+			name:    "negated constant",
+			in:      []Operation{{OP_LOAD, 2}, {OP_NEG, 0}},
+			out:     []Operation{{OP_LOAD, -2}},
+			applied: map[string]int{"negated constant": 1},
+		},
+		{
+			name:    "immediate right operand",
+			in:      []Operation{{OP_LOAD_GLOBAL, 0}, {OP_STORE, 1}, {OP_LOAD, 2}, {OP_SUBTRACT, 1}},
+			out:     []Operation{{OP_LOAD_GLOBAL, 0}, {OP_RSUBTRACTI, 2}},
+			applied: map[string]int{"immediate right operand": 1},
+		},
+		{
+			name:    "immediate right operand of reversed operation",
+			in:      []Operation{{OP_LOAD_GLOBAL, 0}, {OP_STORE, 1}, {OP_LOAD, 2}, {OP_RPOW, 1}},
+			out:     []Operation{{OP_LOAD_GLOBAL, 0}, {OP_POWI, 2}},
+			applied: map[string]int{"immediate right operand": 1},
+		},
+		{
+			name:    "immediate right operand of commutative operation",
+			in:      []Operation{{OP_LOAD_GLOBAL, 0}, {OP_STORE, 1}, {OP_LOAD, 2}, {OP_MULTIPY, 1}},
+			out:     []Operation{{OP_LOAD_GLOBAL, 0}, {OP_MULTIPYI, 2}},
+			applied: map[string]int{"immediate right operand": 1},
+		},
+		{
+			name: "different registers",
+			in:   []Operation{{OP_LOAD_GLOBAL, 0}, {OP_STORE, 1}, {OP_LOAD, 2}, {OP_ADD, 2}},
+			out:  []Operation{{OP_LOAD_GLOBAL, 0}, {OP_STORE, 1}, {OP_LOAD, 2}, {OP_ADD, 2}},
+		},
+		{
+			name:    "immediate left operand",
+			in:      []Operation{{OP_LOAD, 2}, {OP_STORE, 1}, {OP_LOAD_GLOBAL, 0}, {OP_DIVIDE, 1}},
+			out:     []Operation{{OP_LOAD_GLOBAL, 0}, {OP_DIVIDEI, 2}},
+			applied: map[string]int{"immediate left operand": 1},
+		},
+		{
+			name: "constant operands",
+			in: []Operation{
+				{OP_LOAD, 1},
+				{OP_STORE, 1},
+				{OP_LOAD, 2},
+				{OP_ADD, 1},
+				{OP_STORE, 1},
+				{OP_LOAD, 3},
+				{OP_MODULO, 1},
+			},
+			out: []Operation{{OP_LOAD, 0}},
+			applied: map[string]int{
+				"immediate right operand": 2,
+				"constant immediate":      2,
+			},
+		},
+		{
+			name:    "reload of stored variable",
+			in:      []Operation{{OP_LOAD, 1}, {OP_STORE_GLOBAL, 0}, {OP_LOAD_GLOBAL, 0}, {OP_STORE_GLOBAL, 1}, {OP_LOAD_GLOBAL, 0}},
+			out:     []Operation{{OP_LOAD, 1}, {OP_STORE_GLOBAL, 0}, {OP_STORE_GLOBAL, 1}, {OP_LOAD_GLOBAL, 0}},
+			applied: map[string]int{"reload of stored variable": 1},
+		},
+		{
+			name:    "reload of emitted variable",
+			in:      []Operation{{OP_LOAD, 1}, {OP_STORE_GLOBAL, 0}, {OP_RESULT, 0}, {OP_LOAD_GLOBAL, 0}, {OP_RESULT, 0}, {OP_LOAD_GLOBAL, 0}},
+			out:     []Operation{{OP_LOAD, 1}, {OP_STORE_GLOBAL, 0}, {OP_RESULT, 0}, {OP_RESULT, 0}, {OP_LOAD_GLOBAL, 0}},
+			applied: map[string]int{"reload of emitted variable": 1},
+		},
+		{
+			name: "spilled operand",
+			in:   []Operation{{OP_LOAD, 1}, {OP_PUSH, 0}, {OP_LOAD, 2}, {OP_POP, 15}, {OP_ADD, 15}},
+			out:  []Operation{{OP_LOAD, 1}, {OP_PUSH, 0}, {OP_LOAD, 2}, {OP_POP, 15}, {OP_ADD, 15}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := append([]Operation{}, test.in...)
+			out, report := Peephole(test.in)
+			assert.Equal(t, test.out, out)
+			assert.Equal(t, in, test.in, "the input is modified")
+			assert.Equal(t, len(test.in)-len(test.out), report.Eliminated())
+			for name, count := range test.applied {
+				assert.Equal(t, count, report.Applied[name], name)
+			}
+
+			// the rewritten operations compute the same result
+			vm := Vm{env: NewEnv()}
+			vm.env.declare("x")
+			vm.env.declare("y")
+			vm.env.store(0, 3)
+			assert.NoError(t, vm.NewVmIn(test.in).Execute())
+			expected := vm.reg[0]
+			assert.NoError(t, vm.NewVmIn(out).Execute())
+			assert.True(t, sameFloat(expected, vm.reg[0]), "expected %v, got %v", expected, vm.reg[0])
+		})
+	}
+}
+
+func TestPeepholeCompiled(t *testing.T) {
+	tests := []string{
+		"1+2*3-4/5",
+		"2 - 3 // 4 % 5 ^ 2",
+		"x = 3\nx*2 - 1/x + 2^x - x^2",
+		"x = 3\ny = --x - -(x // 2)",
+		"f(a, b) = 2*a - b/2 + 3 % a\nf(5, 4) + f(2, 1)",
+		"x = 3\ny = 2 - x\ny * x",
+		"x = 3\ny = 2 / x",
+		balanced("-", "2", SPILL_REGISTER),
+	}
+	for _, in := range tests {
+		t.Run(in, func(t *testing.T) {
+			ast := parse(t, in)
+			vm := Vm{env: NewEnv()}
+			ops, err := Compile(vm.env, ast)
+			assert.NoError(t, err)
+			assert.NoError(t, vm.NewVmIn(ops).Execute())
+			expected := vm.reg[0]
+
+			compiler := NewCompiler(NewEnv())
+			compiler.Peephole = true
+			optimized, err := compiler.Compile(ast)
+			assert.NoError(t, err)
+			assert.Greater(t, compiler.Report.Eliminated(), 0)
+			vm = Vm{env: compiler.env}
+			assert.NoError(t, vm.NewVmIn(optimized).Execute())
+			assert.True(t, sameFloat(expected, vm.reg[0]), "expected %v, got %v", expected, vm.reg[0])
+		})
+	}
+}
+
+func TestPeepholeReport(t *testing.T) {
+	_, report := Peephole([]Operation{{OP_LOAD, 1}, {OP_NEG, 0}, {OP_NEG, 0}, {OP_NEG, 0}, {OP_NOP, 0}})
+	assert.Equal(t, "eliminated 4 of 5 operations (no operation: 1, negated constant: 3)", report.String())
+	_, report = Peephole([]Operation{{OP_LOAD, 1}})
+	assert.Equal(t, "eliminated 0 of 1 operations", report.String())
+}
@@ -0,0 +1,76 @@
+package main
+
+import "fmt"
+
+// Program is bytecode together with the symbols it references: the names of
+// the variable slots of OP_LOAD_GLOBAL and OP_STORE_GLOBAL and the functions
+// OP_CALL_FUNC calls. Loading a program into an Env defines its symbols in
+// the same slots, so the bytecode can be executed outside of the Env it was
+// compiled in
+type Program struct {
+	Code      []Operation
+	Spans     []Span      // location in the input of each operation of Code, may be nil
+	Globals   []string    // variable names by slot
+	Functions []*Function // functions by slot, nil for slots of removed functions, see Function.declaration for declared ones
+	Source    string      // input the program was compiled from, may be empty
+}
+
+// creates a program of code and the symbols defined in env
+func NewProgram(env *Env, code []Operation, spans []Span) *Program {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	p := &Program{
+		Code:      code,
+		Spans:     spans,
+		Globals:   make([]string, len(env.vars)),
+		Functions: make([]*Function, len(env.funcs)),
+	}
+	for i, v := range env.vars {
+		p.Globals[i] = v.name
+	}
+	copy(p.Functions, env.funcs)
+	for name, slot := range env.funcSlots {
+		if p.Functions[slot] == nil {
+			p.Functions[slot] = &Function{Name: name}
+		}
+	}
+	return p
+}
+
+// declares the variables and defines the functions of the program in env,
+// errors if a symbol would end up in a different slot than the bytecode
+// expects, for instance if env already contains other variables
+func (p *Program) Load(env *Env) error {
+	for i, name := range p.Globals {
+		if _, ok := env.Const(name); ok {
+			return fmt.Errorf("variable %q in slot %d is a constant", name, i)
+		}
+		if slot := env.declare(name); slot != i {
+			return fmt.Errorf("variable %q expected in slot %d, got slot %d", name, i, slot)
+		}
+	}
+	for i, f := range p.Functions {
+		if f == nil {
+			if slot := env.reserveFunc(""); slot != i {
+				return fmt.Errorf("function expected in slot %d, got slot %d", i, slot)
+			}
+			continue
+		}
+		if _, ok := lookupBuiltin(f.Name); ok {
+			return fmt.Errorf("function %q in slot %d redefines a builtin", f.Name, i)
+		}
+		if f.declaration() {
+			if _, ok := env.lookupFunc(f.Name); ok {
+				return fmt.Errorf("function %q is already defined", f.Name)
+			}
+			if slot := env.reserveFunc(f.Name); slot != i {
+				return fmt.Errorf("function %q expected in slot %d, got slot %d", f.Name, i, slot)
+			}
+			continue
+		}
+		if slot := env.defineFunc(f); slot != i {
+			return fmt.Errorf("function %q expected in slot %d, got slot %d", f.Name, i, slot)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maximum amount of lines kept in the history file
+const HISTORY_SIZE = 1000
+
+const REPL_HELP = `enter expressions to evaluate them, 'ans' and '_' hold the last result
+commands:
+  :tokens <expr>    print the tokens of the expression
+  :ast <expr>       print the abstract syntax tree of the expression
+  :bytecode <expr>  print the bytecode of the expression without executing it
+  :trace on|off     trace the operations the vm executes
+  :vars             print the defined variables and functions
+  :clear            remove all variables and functions
+  :help             print this help
+  :quit             leave the repl, as does ctrl-d`
+
+// Repl reads expressions line by line and evaluates them in a shared
+// environment, variables and functions defined on a line are available on
+// the following lines. Lines starting with ':' are commands, see REPL_HELP
+type Repl struct {
+	Backend         string // 'vm' or 'tree'
+	Optimize        bool
+	Peephole        bool
+	MaxInstructions int           // see Vm.MaxInstructions, Interpreter.MaxNodes for the tree backend
+	MaxCallDepth    int           // see Vm.MaxCallDepth
+	Timeout         time.Duration // stops evaluating a line after the duration, 0 for no limit
+	Trace           Tracer        // traces the vm unless ':trace on' traces to the output, may be nil
+	HistoryFile     string        // the history is loaded from the file and every line appended to it, empty to disable
+	env             *Env
+	in              LineReader
+	out             io.Writer
+	trace           bool
+	last            string // last line of the history, repeating it adds nothing
+}
+
+// creates a repl reading lines from in and writing results to out,
+// evaluating with the vm and all optimizations enabled
+func NewRepl(in LineReader, out io.Writer) *Repl {
+	r := &Repl{Backend: "vm", Optimize: true, Peephole: true, in: in, out: out}
+	r.clear()
+	return r
+}
+
+// default location of the history file, in the configuration directory of
+// the user
+func DefaultHistoryFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "calc", "history"), nil
+}
+
+// reads the last HISTORY_SIZE lines of the history file, a missing file is
+// an empty history. A longer file is rewritten to contain only these lines
+func LoadHistory(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) <= HISTORY_SIZE {
+		return lines, nil
+	}
+	lines = lines[len(lines)-HISTORY_SIZE:]
+	return lines, writeHistory(path, lines)
+}
+
+// replaces the history file with lines, writes a temporary file first so an
+// interrupted write keeps the old history
+func writeHistory(path string, lines []string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".history")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// reads and evaluates lines until the input ends or the user quits
+func (r *Repl) Run() error {
+	r.loadHistory()
+	for {
+		line, err := r.in.ReadLine("> ")
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		// like the line editor the file skips consecutive repeats
+		if line != r.last {
+			r.in.AddHistory(line)
+			if err := r.appendHistory(line); err != nil {
+				fmt.Fprintf(r.out, "history: %s\n", err)
+				r.HistoryFile = ""
+			}
+			r.last = line
+		}
+		if strings.HasPrefix(line, ":") {
+			if !r.command(line) {
+				return nil
+			}
+			continue
+		}
+		r.eval(line)
+	}
+}
+
+// adds the lines of the history file to the history of the reader
+func (r *Repl) loadHistory() {
+	if r.HistoryFile == "" {
+		return
+	}
+	history, err := LoadHistory(r.HistoryFile)
+	if err != nil {
+		fmt.Fprintf(r.out, "history: %s\n", err)
+	}
+	for _, line := range history {
+		r.in.AddHistory(line)
+	}
+	if len(history) > 0 {
+		r.last = history[len(history)-1]
+	}
+}
+
+func (r *Repl) appendHistory(line string) error {
+	if r.HistoryFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(r.HistoryFile), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.HistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replaces the environment with an empty one
+func (r *Repl) clear() {
+	r.env = NewEnv()
+	r.env.Set("ans", 0)
+	r.env.Set("_", 0)
+}
+
+// evaluates the line, prints its results and binds the last one to 'ans' and
+// '_'. Errors are printed, the environment keeps the changes made before
+func (r *Repl) eval(line string) {
+	results, err := r.evalResults(line)
+	if err != nil {
+		RenderError(r.out, line, err)
+		return
+	}
+	for _, v := range results {
+		fmt.Fprintf(r.out, "=> %v\n", v)
+	}
+	if len(results) > 0 {
+		r.env.Set("ans", results[len(results)-1])
+		r.env.Set("_", results[len(results)-1])
+	}
+}
+
+func (r *Repl) evalResults(line string) ([]float64, error) {
+	ast, err := r.parse(line)
+	if err != nil {
+		return nil, err
+	}
+	if r.Optimize {
+		ast = Optimize(r.env, ast)
+	}
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	if r.Backend == "tree" {
+		in := NewInterpreter(r.env)
+		in.MaxNodes, in.MaxCallDepth = r.MaxInstructions, r.MaxCallDepth
+		return in.EvalContext(ctx, ast)
+	}
+	code, _, err := r.compile(ast)
+	if err != nil {
+		return nil, err
+	}
+	vm := &Vm{env: r.env, Trace: r.Trace, MaxInstructions: r.MaxInstructions, MaxCallDepth: r.MaxCallDepth}
+	if r.trace {
+		vm.Trace = TextTracer(r.out)
+	}
+	err = vm.NewVmIn(code).ExecuteContext(ctx)
+	return vm.Results(), err
+}
+
+func (r *Repl) parse(line string) ([]Node, error) {
+	token, err := NewLexer(strings.NewReader(line)).Lex()
+	if err != nil {
+		return nil, err
+	}
+	return NewParser(token).Parse()
+}
+
+func (r *Repl) compile(ast []Node) ([]Operation, []Span, error) {
+	compiler := NewCompiler(r.env)
+	compiler.Peephole = r.Peephole
+	code, err := compiler.Compile(ast)
+	return code, compiler.Spans, err
+}
+
+// executes a command, returns false if the user quit
+func (r *Repl) command(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case ":tokens":
+		token, err := NewLexer(strings.NewReader(arg)).Lex()
+		if err != nil {
+			RenderError(r.out, arg, err)
+			return true
+		}
+		for i, t := range token {
+			fmt.Fprintf(r.out, "%5d | %15s | %15s | %7s\n", i, TOKEN_LOOKUP[t.Type], t.Raw, t.Span.Start)
+		}
+	case ":ast":
+		ast, err := r.parse(arg)
+		if err != nil {
+			RenderError(r.out, arg, err)
+			return true
+		}
+		for _, n := range ast {
+			fmt.Fprintln(r.out, n.String(0))
+		}
+	case ":bytecode":
+		if err := r.bytecode(arg); err != nil {
+			RenderError(r.out, arg, err)
+		}
+	case ":trace":
+		switch {
+		case r.Backend == "tree":
+			fmt.Fprintln(r.out, "tracing requires the vm backend, the tree walk interpreter executes no operations")
+		case arg == "on":
+			r.trace = true
+		case arg == "off":
+			r.trace = false
+		default:
+			fmt.Fprintln(r.out, "usage: :trace on|off")
+		}
+	case ":vars":
+		r.vars()
+	case ":clear":
+		r.clear()
+	case ":help":
+		fmt.Fprintln(r.out, REPL_HELP)
+	case ":quit", ":q":
+		return false
+	default:
+		fmt.Fprintf(r.out, "unknown command %q, see ':help'\n", name)
+	}
+	return true
+}
+
+// compiles the expression in a copy of the environment and disassembles it,
+// functions and variables it defines are not kept
+func (r *Repl) bytecode(input string) error {
+	ast, err := r.parse(input)
+	if err != nil {
+		return err
+	}
+	env := NewEnv()
+	if err := NewProgram(r.env, nil, nil).Load(env); err != nil {
+		return err
+	}
+	if r.Optimize {
+		ast = Optimize(env, ast)
+	}
+	compiler := NewCompiler(env)
+	compiler.Peephole = r.Peephole
+	code, err := compiler.Compile(ast)
+	if err != nil {
+		return err
+	}
+	b := &strings.Builder{}
+	disassembleChunk(b, NewProgram(env, code, compiler.Spans), code, compiler.Spans, input)
+	_, err = io.WriteString(r.out, b.String())
+	return err
+}
+
+// prints the assigned variables with their values and the functions with
+// their parameters
+func (r *Repl) vars() {
+	p := NewProgram(r.env, nil, nil)
+	for _, name := range p.Globals {
+		if v, ok := r.env.Get(name); ok {
+			fmt.Fprintf(r.out, "%s = %v\n", name, v)
+		}
+	}
+	for _, f := range p.Functions {
+		if f != nil && !f.declaration() {
+			fmt.Fprintf(r.out, "%s(%s)\n", f.Name, strings.Join(f.Params, ", "))
+		}
+	}
+}
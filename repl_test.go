@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func runTestRepl(t *testing.T, r *Repl, lines ...string) string {
+	t.Helper()
+	out := &strings.Builder{}
+	r.in = &plainReader{scanner: bufio.NewScanner(strings.NewReader(strings.Join(lines, "\n"))), out: out}
+	r.out = out
+	assert.NoError(t, r.Run())
+	return out.String()
+}
+
+func TestRepl(t *testing.T) {
+	for _, backend := range []string{"vm", "tree"} {
+		t.Run(backend, func(t *testing.T) {
+			r := NewRepl(nil, nil)
+			r.Backend = backend
+			out := runTestRepl(t, r,
+				"x = 3",
+				"f(a) = a + x",
+				"f(ans)",
+				"_ * 2",
+				"1/",
+				"ans",
+				":vars",
+				":clear",
+				"ans",
+				":vars",
+				":quit",
+				"1",
+			)
+			assert.Equal(t, strings.Join([]string{
+				"> => 3",
+				"> > => 6",
+				"> => 12",
+				"> error[E002]: expected expression, got end of input",
+				" --> 1:3",
+				"  |",
+				"1 | 1/",
+				"  |   ^ expected a number, a variable, '-' or '('",
+				"> => 12",
+				"> ans = 12",
+				"_ = 12",
+				"x = 3",
+				"f(a)",
+				"> > => 0",
+				"> ans = 0",
+				"_ = 0",
+				"> ",
+			}, "\n"), out)
+		})
+	}
+}
+
+func TestReplCommands(t *testing.T) {
+	r := NewRepl(nil, nil)
+	out := runTestRepl(t, r, ":tokens 1+x", ":ast 1+x", "y = 2", ":bytecode y = y * 2", "y", ":unknown", ":trace")
+	assert.Contains(t, out, "    1 |      TOKEN_PLUS |               + |     1:2\n")
+	assert.Contains(t, out, "+\n  1\n  x\n")
+	assert.Contains(t, out, "OP_STORE_GLOBAL   2        ; y = y * 2\n")
+	// :bytecode does not execute the expression
+	assert.Contains(t, out, "> => 2\n")
+	assert.Contains(t, out, `unknown command ":unknown", see ':help'`)
+	assert.Contains(t, out, "usage: :trace on|off")
+
+	// functions called before their definition are not listed
+	out = runTestRepl(t, r, "f(x) = g(x) + 1", ":vars")
+	assert.Contains(t, out, "f(x)\n")
+	assert.NotContains(t, out, "g(")
+
+	out = runTestRepl(t, r, ":trace on", "1+1", ":trace off", "2+2")
+	assert.Contains(t, out, "OP_RESULT")
+	assert.Equal(t, 1, strings.Count(out, "OP_RESULT"))
+}
+
+func TestReplHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calc", "history")
+	history, err := LoadHistory(path)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+
+	r := NewRepl(nil, nil)
+	r.HistoryFile = path
+	runTestRepl(t, r, "1+1", "", ":vars")
+	runTestRepl(t, r, "x = 2")
+	history, err = LoadHistory(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1+1", ":vars", "x = 2"}, history)
+
+	// consecutive repeats are skipped, also of the last line of the file
+	runTestRepl(t, r, "x = 2", "1+1", "1+1", "x = 2")
+	history, err = LoadHistory(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1+1", ":vars", "x = 2", "1+1", "x = 2"}, history)
+
+	// the loaded history is passed to the reader
+	editor := &LineEditor{}
+	r.in = editor
+	r.loadHistory()
+	assert.Equal(t, history, editor.History)
+
+	lines := make([]string, HISTORY_SIZE+2)
+	for i := range lines {
+		lines[i] = "1"
+	}
+	lines[len(lines)-1] = "last"
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600))
+	history, err = LoadHistory(path)
+	assert.NoError(t, err)
+	assert.Len(t, history, HISTORY_SIZE)
+	assert.Equal(t, "last", history[HISTORY_SIZE-1])
+
+	// the file is trimmed as well
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, HISTORY_SIZE, strings.Count(string(data), "\n"))
+	assert.True(t, strings.HasSuffix(string(data), "1\nlast\n"))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestReplBudgets(t *testing.T) {
+	for _, backend := range []string{"vm", "tree"} {
+		t.Run(backend, func(t *testing.T) {
+			r := NewRepl(nil, nil)
+			r.Backend, r.Timeout = backend, 50*time.Millisecond
+			out := runTestRepl(t, r, strings.Split(callChain(40), "\n")...)
+			assert.Contains(t, out, "error: context deadline exceeded")
+
+			r.MaxCallDepth = 5
+			out = runTestRepl(t, r, "g(x) = g(x)", "g(1)", "1+1")
+			assert.Contains(t, out, "error[E019]: call depth budget of 5 exceeded")
+			assert.Contains(t, out, "=> 2\n")
+		})
+	}
+
+	r := NewRepl(nil, nil)
+	records := 0
+	r.Trace = func(TraceRecord) { records++ }
+	runTestRepl(t, r, "1+1")
+	assert.Equal(t, 2, records)
+
+	r.Backend = "tree"
+	out := runTestRepl(t, r, ":trace on")
+	assert.Contains(t, out, "tracing requires the vm backend")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// state of the vm around the execution of a single operation
+type TraceRecord struct {
+	Pc       int                     // index of the operation in its chunk
+	Function string                  // function the operation belongs to, empty for the main code
+	Depth    int                     // amount of active calls of user defined functions
+	Op       Operation               // executed operation
+	Before   [REGISTER_COUNT]float64 // registers before the operation
+	After    [REGISTER_COUNT]float64 // registers after the operation, the callee's for OP_CALL_FUNC and the caller's for OP_RETURN
+}
+
+// receives a record for every operation the vm executed successfully
+type Tracer func(r TraceRecord)
+
+// writes a line for every record to w, operations of functions are indented
+// by the depth of the call, changed registers are listed after the operation:
+//
+//	0002  OP_ADDI           1         r0 40 -> 41
+func TextTracer(w io.Writer) Tracer {
+	return func(r TraceRecord) {
+		name, ok := OP_LOOKUP[r.Op.Code]
+		if !ok {
+			name = fmt.Sprintf("OP_UNKNOWN_%d", r.Op.Code)
+		}
+		arg := ""
+		if !OP_NO_ARGUMENT[r.Op.Code] {
+			arg = strconv.FormatFloat(r.Op.Arg, 'g', -1, 64)
+		}
+		changes := make([]string, 0)
+		for i := range r.Before {
+			if !sameFloat(r.Before[i], r.After[i]) {
+				changes = append(changes, fmt.Sprintf("r%d %v -> %v", i, r.Before[i], r.After[i]))
+			}
+		}
+		line := fmt.Sprintf("%s%04d  %-17s %-8s  %s", strings.Repeat("  ", r.Depth), r.Pc, name, arg, strings.Join(changes, ", "))
+		io.WriteString(w, strings.TrimRight(line, " ")+"\n")
+	}
+}
+
+// writes every record to w as a JSON object on its own line. Registers are
+// numbers, except NaN and infinities, which JSON can not represent, those
+// are the strings "NaN", "+Inf" and "-Inf"
+func JSONTracer(w io.Writer) Tracer {
+	enc := json.NewEncoder(w)
+	return func(r TraceRecord) {
+		enc.Encode(struct {
+			Pc       int    `json:"pc"`
+			Function string `json:"function,omitempty"`
+			Depth    int    `json:"depth"`
+			Op       string `json:"op"`
+			Arg      any    `json:"arg"`
+			Before   []any  `json:"before"`
+			After    []any  `json:"after"`
+		}{
+			Pc:       r.Pc,
+			Function: r.Function,
+			Depth:    r.Depth,
+			Op:       OP_LOOKUP[r.Op.Code],
+			Arg:      jsonNumber(r.Op.Arg),
+			Before:   jsonRegisters(r.Before),
+			After:    jsonRegisters(r.After),
+		})
+	}
+}
+
+func jsonNumber(v float64) any {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return v
+}
+
+func jsonRegisters(reg [REGISTER_COUNT]float64) []any {
+	values := make([]any, len(reg))
+	for i, v := range reg {
+		values[i] = jsonNumber(v)
+	}
+	return values
+}
+
+// like ==, but NaN equals NaN
+func sameFloat(a, b float64) bool {
+	return a == b || (math.IsNaN(a) && math.IsNaN(b))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceRecords(t *testing.T) {
+	p := compileProgram(t, "f(x) = x*2\nf(20)+1")
+	records := make([]TraceRecord, 0)
+	vm := Vm{env: NewEnv(), Trace: func(r TraceRecord) { records = append(records, r) }}
+	assert.NoError(t, p.Load(vm.env))
+	assert.NoError(t, vm.NewVmIn(p.Code).Execute())
+
+	exp := []struct {
+		pc       int
+		function string
+		depth    int
+		code     OpCode
+	}{
+		{0, "", 0, OP_LOAD},
+		{1, "", 0, OP_PUSH},
+		{2, "", 0, OP_LOAD},
+		{3, "", 0, OP_CALL_FUNC},
+		{0, "f", 1, OP_LOAD_LOCAL},
+		{1, "f", 1, OP_MULTIPYI},
+		{2, "f", 1, OP_RETURN},
+		{4, "", 0, OP_ADDI},
+		{5, "", 0, OP_RESULT},
+	}
+	assert.Len(t, records, len(exp))
+	for i, e := range exp {
+		r := records[i]
+		assert.Equal(t, e.pc, r.Pc, "record %d", i)
+		assert.Equal(t, e.function, r.Function, "record %d", i)
+		assert.Equal(t, e.depth, r.Depth, "record %d", i)
+		assert.Equal(t, e.code, r.Op.Code, "record %d", i)
+	}
+	assert.Equal(t, float64(20), records[5].Before[0])
+	assert.Equal(t, float64(40), records[5].After[0])
+	assert.Equal(t, float64(41), records[7].After[0])
+}
+
+func TestTraceFailedOperation(t *testing.T) {
+	count := 0
+	vm := Vm{Trace: func(TraceRecord) { count++ }}
+	assert.Error(t, vm.NewVmIn([]Operation{{OP_LOAD, 1}, {OP_POP, 1}}).Execute())
+	assert.Equal(t, 1, count)
+}
+
+func TestTextTracer(t *testing.T) {
+	p := compileProgram(t, "f(x) = x*2\nf(20)+1")
+	b := &bytes.Buffer{}
+	vm := Vm{env: NewEnv(), Trace: TextTracer(b)}
+	assert.NoError(t, p.Load(vm.env))
+	assert.NoError(t, vm.NewVmIn(p.Code).Execute())
+	assert.Equal(t, strings.Join([]string{
+		"0000  OP_LOAD           20        r0 0 -> 20",
+		"0001  OP_PUSH",
+		"0002  OP_LOAD           1         r0 20 -> 1",
+		"0003  OP_CALL_FUNC      0         r0 1 -> 0",
+		"  0000  OP_LOAD_LOCAL     0         r0 0 -> 20",
+		"  0001  OP_MULTIPYI       2         r0 20 -> 40",
+		"  0002  OP_RETURN",
+		"0004  OP_ADDI           1         r0 40 -> 41",
+		"0005  OP_RESULT",
+		"",
+	}, "\n"), b.String())
+}
+
+func TestJSONTracer(t *testing.T) {
+	b := &bytes.Buffer{}
+	vm := Vm{Trace: JSONTracer(b)}
+	assert.NoError(t, vm.NewVmIn([]Operation{{OP_LOAD, 2}, {OP_STORE, 1}, {OP_LOAD, math.Inf(1)}, {OP_ADDI, math.NaN()}}).Execute())
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	assert.Len(t, lines, 4)
+	var record struct {
+		Pc     int    `json:"pc"`
+		Op     string `json:"op"`
+		Arg    any    `json:"arg"`
+		Before []any  `json:"before"`
+		After  []any  `json:"after"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, 1, record.Pc)
+	assert.Equal(t, "OP_STORE", record.Op)
+	assert.Equal(t, float64(1), record.Arg)
+	assert.Equal(t, float64(2), record.Before[0])
+	assert.Equal(t, float64(0), record.After[0])
+	assert.Equal(t, float64(2), record.After[1])
+
+	assert.NoError(t, json.Unmarshal([]byte(lines[3]), &record))
+	assert.Equal(t, "NaN", record.Arg)
+	assert.Equal(t, "+Inf", record.Before[0])
+	assert.Equal(t, "NaN", record.After[0])
+}
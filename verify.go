@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// returned by Verify for every operation violating the rules of the Vm
+type VerifyError struct {
+	Function string    // name of the function containing the operation, empty for the main code
+	Pos      int       // index of the operation in its chunk, -1 if the violation concerns the whole function
+	Op       Operation // offending operation
+	Span     Span      // source of the operation, zero if the program has no spans
+	Msg      string    // description of the violation
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verify: %s at %s", e.Msg, e.location())
+}
+
+func (e *VerifyError) Diagnostic() *Diagnostic {
+	return &Diagnostic{
+		Code: CODE_VERIFY,
+		Msg:  fmt.Sprintf("%s at %s", e.Msg, e.location()),
+		Span: e.Span,
+	}
+}
+
+// position of the operation and the function containing it, violations of
+// a whole function have a negative Pos
+func (e *VerifyError) location() string {
+	if e.Pos < 0 {
+		return "function " + e.Function
+	}
+	op := fmt.Sprintf("%d (opcode %d)", e.Pos, e.Op.Code)
+	if name, ok := OP_LOOKUP[e.Op.Code]; ok {
+		op = fmt.Sprintf("%d (%s %v)", e.Pos, name, e.Op.Arg)
+	}
+	if e.Function != "" {
+		return fmt.Sprintf("%s in function %s", op, e.Function)
+	}
+	return op
+}
+
+// kind of the argument an operation expects
+type argKind int
+
+const (
+	ARG_NONE argKind = iota
+	ARG_VALUE
+	ARG_REGISTER
+	ARG_GLOBAL
+	ARG_BUILTIN
+	ARG_FUNCTION
+	ARG_PARAM
+)
+
+// argument kind of every operation
+var OP_ARGUMENT = func() map[OpCode]argKind {
+	m := map[OpCode]argKind{
+		OP_NOP:          ARG_NONE,
+		OP_LOAD:         ARG_VALUE,
+		OP_STORE:        ARG_REGISTER,
+		OP_NEG:          ARG_NONE,
+		OP_INSPECT:      ARG_REGISTER,
+		OP_LOAD_GLOBAL:  ARG_GLOBAL,
+		OP_STORE_GLOBAL: ARG_GLOBAL,
+		OP_PUSH:         ARG_NONE,
+		OP_POP:          ARG_REGISTER,
+		OP_CALL:         ARG_BUILTIN,
+		OP_CALL_FUNC:    ARG_FUNCTION,
+		OP_LOAD_LOCAL:   ARG_PARAM,
+		OP_RETURN:       ARG_NONE,
+		OP_RESULT:       ARG_NONE,
+	}
+	for code, op := range ARITHMETIC {
+		if op.immediate {
+			m[code] = ARG_VALUE
+		} else {
+			m[code] = ARG_REGISTER
+		}
+	}
+	return m
+}()
+
+// statically checks the code of p and its functions before execution.
+// Returns an ErrorList of *VerifyError for every violation found, nil if p
+// is valid:
+//
+//   - every opcode is known and operations without argument have none
+//   - registers, variable slots, builtins, functions and parameters
+//     referenced by operations are integers and exist
+//   - calls have a constant amount of arguments loaded into register 0
+//     directly before them, accepted by the callee unless it is declared only
+//   - the stack never underflows, functions leave it as they found it and
+//     end with their only OP_RETURN, the main code contains none
+//   - only the main code emits results
+//
+// The Vm has no jumps, the only transfer of control are calls, therefore
+// checking the call targets covers all targets of control flow
+func Verify(p *Program) error {
+	errs := ErrorList{}
+	for _, f := range p.Functions {
+		if f != nil && !f.declaration() {
+			errs = append(errs, verifyChunk(p, f, f.Code, f.Spans)...)
+		}
+	}
+	errs = append(errs, verifyChunk(p, nil, p.Code, p.Spans)...)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// verifies the operations of fn, or of the main code if fn is nil
+func verifyChunk(p *Program, fn *Function, code []Operation, spans []Span) []error {
+	errs := make([]error, 0)
+	fail := func(pos int, format string, a ...any) {
+		e := &VerifyError{Pos: pos, Op: code[pos], Msg: fmt.Sprintf(format, a...)}
+		if fn != nil {
+			e.Function = fn.Name
+		}
+		if len(spans) == len(code) {
+			e.Span = spans[pos]
+		}
+		errs = append(errs, e)
+	}
+
+	depth := 0        // values on the stack pushed by this chunk
+	argc := -1        // value of register 0 if it was loaded directly before, else -1
+	returned := false // an OP_RETURN was verified
+	for pos, op := range code {
+		kind, ok := OP_ARGUMENT[op.Code]
+		if !ok {
+			fail(pos, "unknown opcode %d", op.Code)
+			argc = -1
+			continue
+		}
+		if returned {
+			fail(pos, "unreachable operation after %s", OP_LOOKUP[OP_RETURN])
+			returned = false
+		}
+
+		arg := int(op.Arg)
+		switch {
+		case kind == ARG_NONE:
+			if op.Arg != 0 {
+				fail(pos, "%s takes no argument", OP_LOOKUP[op.Code])
+			}
+		case kind == ARG_VALUE:
+		case math.IsNaN(op.Arg) || math.IsInf(op.Arg, 0) || op.Arg != math.Trunc(op.Arg):
+			fail(pos, "argument %v is not an integer", op.Arg)
+			kind = ARG_NONE
+		}
+
+		switch kind {
+		case ARG_REGISTER:
+			if arg < 0 || arg >= REGISTER_COUNT {
+				fail(pos, "register %d out of bounds, the vm has %d registers", arg, REGISTER_COUNT)
+			}
+		case ARG_GLOBAL:
+			if arg < 0 || arg >= len(p.Globals) {
+				fail(pos, "variable slot %d out of bounds, %s declared", arg, plural(len(p.Globals), "variable"))
+			}
+		case ARG_PARAM:
+			if fn == nil {
+				fail(pos, "parameter access outside of a function")
+			} else if arg < 0 || arg >= len(fn.Params) {
+				fail(pos, "parameter %d out of bounds, %s has %s", arg, fn.Name, plural(len(fn.Params), "parameter"))
+			}
+		case ARG_BUILTIN, ARG_FUNCTION:
+			var checkArity func(int) error
+			if kind == ARG_BUILTIN {
+				if arg < 0 || arg >= len(BUILTINS) {
+					fail(pos, "unknown builtin %d", arg)
+					break
+				}
+				checkArity = BUILTINS[arg].checkArity
+			} else {
+				if arg < 0 || arg >= len(p.Functions) || p.Functions[arg] == nil {
+					fail(pos, "unknown function %d", arg)
+					break
+				}
+				// the parameters of declared functions are unknown, the vm
+				// checks the arguments once the function is defined
+				checkArity = p.Functions[arg].checkArity
+				if p.Functions[arg].declaration() {
+					checkArity = func(int) error { return nil }
+				}
+			}
+			switch {
+			case argc < 0:
+				fail(pos, "amount of arguments is not loaded into register 0 before the call")
+			case argc > depth:
+				fail(pos, "call takes %d arguments from the stack, only %d pushed", argc, depth)
+				depth = 0
+			default:
+				if err := checkArity(argc); err != nil {
+					fail(pos, "%s", err)
+				}
+				depth -= argc
+			}
+		}
+
+		switch op.Code {
+		case OP_PUSH:
+			depth++
+		case OP_POP:
+			if depth == 0 {
+				fail(pos, "pop from empty stack")
+			} else {
+				depth--
+			}
+		case OP_RETURN:
+			if fn == nil {
+				fail(pos, "return outside of a function")
+				break
+			}
+			if depth != 0 {
+				fail(pos, "function returns with %s left on the stack", plural(depth, "value"))
+			}
+			returned = true
+		case OP_RESULT:
+			if fn != nil {
+				fail(pos, "result inside a function")
+			}
+		}
+
+		argc = -1
+		switch {
+		case op.Code == OP_LOAD && op.Arg >= 0 && op.Arg == math.Trunc(op.Arg) && op.Arg <= float64(math.MaxInt32):
+			argc = int(op.Arg)
+		case op.Code == OP_STORE:
+			argc = 0
+		}
+	}
+
+	if fn != nil && (len(code) == 0 || code[len(code)-1].Code != OP_RETURN) {
+		errs = append(errs, &VerifyError{Function: fn.Name, Pos: -1, Msg: fmt.Sprintf("missing %s at the end", OP_LOOKUP[OP_RETURN])})
+	}
+	return errs
+}
+
+// n followed by noun, pluralized if n is not 1
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
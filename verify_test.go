@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyCompiled(t *testing.T) {
+	tests := []string{
+		"1+2*3",
+		"x = 3\ny = x - 1\nx * y",
+		"f(a, b) = a^b\ng(x) = f(x, 2) + 1\ng(3)",
+		"max(1, sqrt(16), 2) + min(3, 4)",
+		"f(x) = f(x)\n1",
+		"x = 1\n" + balanced("-", "x", SPILL_REGISTER),
+		"f(x) = " + balanced("*", "max(x, 2)", SPILL_REGISTER) + "\nf(1)",
+	}
+	for _, in := range tests {
+		t.Run(in, func(t *testing.T) {
+			assert.NoError(t, Verify(compileProgram(t, in)))
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f := &Function{Name: "f", Params: []string{"x"}, Code: []Operation{{OP_LOAD_LOCAL, 0}, {OP_RETURN, 0}}}
+	tests := []struct {
+		name      string
+		code      []Operation
+		functions []*Function
+		exp       []string
+	}{
+		{
+			name: "unknown opcode",
+			code: []Operation{{OpCode(255), 0}},
+			exp:  []string{"unknown opcode 255 at 0 (opcode 255)"},
+		},
+		{
+			name: "argument of operation without argument",
+			code: []Operation{{OP_NEG, 1}},
+			exp:  []string{"OP_NEG takes no argument at 0 (OP_NEG 1)"},
+		},
+		{
+			name: "register out of bounds",
+			code: []Operation{{OP_STORE, 16}, {OP_ADD, -1}, {OP_INSPECT, 15}},
+			exp: []string{
+				"register 16 out of bounds, the vm has 16 registers at 0 (OP_STORE 16)",
+				"register -1 out of bounds, the vm has 16 registers at 1 (OP_ADD -1)",
+			},
+		},
+		{
+			name: "non integer argument",
+			code: []Operation{{OP_STORE, 1.5}, {OP_LOAD_GLOBAL, 0.5}, {OP_ADDI, 0.5}},
+			exp: []string{
+				"argument 1.5 is not an integer at 0 (OP_STORE 1.5)",
+				"argument 0.5 is not an integer at 1 (OP_LOAD_GLOBAL 0.5)",
+			},
+		},
+		{
+			name: "variable out of bounds",
+			code: []Operation{{OP_LOAD_GLOBAL, 1}},
+			exp:  []string{"variable slot 1 out of bounds, 1 variable declared at 0 (OP_LOAD_GLOBAL 1)"},
+		},
+		{
+			name: "parameter outside of function",
+			code: []Operation{{OP_LOAD_LOCAL, 0}},
+			exp:  []string{"parameter access outside of a function at 0 (OP_LOAD_LOCAL 0)"},
+		},
+		{
+			name: "unknown call targets",
+			code: []Operation{{OP_LOAD, 0}, {OP_CALL, float64(len(BUILTINS))}, {OP_LOAD, 0}, {OP_CALL_FUNC, 1}},
+			exp: []string{
+				"unknown builtin 24 at 1 (OP_CALL 24)",
+				"unknown function 1 at 3 (OP_CALL_FUNC 1)",
+			},
+			functions: []*Function{f},
+		},
+		{
+			name:      "removed function",
+			code:      []Operation{{OP_LOAD, 0}, {OP_CALL_FUNC, 0}},
+			exp:       []string{"unknown function 0 at 1 (OP_CALL_FUNC 0)"},
+			functions: []*Function{nil},
+		},
+		{
+			name: "argument count not loaded",
+			code: []Operation{{OP_PUSH, 0}, {OP_NEG, 0}, {OP_CALL, float64(builtinIndex["sqrt"])}},
+			exp:  []string{"amount of arguments is not loaded into register 0 before the call at 2 (OP_CALL 1)"},
+		},
+		{
+			name: "arguments missing on stack",
+			code: []Operation{{OP_PUSH, 0}, {OP_LOAD, 2}, {OP_CALL, float64(builtinIndex["hypot"])}},
+			exp:  []string{"call takes 2 arguments from the stack, only 1 pushed at 2 (OP_CALL 21)"},
+		},
+		{
+			name:      "wrong arity",
+			code:      []Operation{{OP_PUSH, 0}, {OP_PUSH, 0}, {OP_LOAD, 2}, {OP_CALL_FUNC, 0}},
+			functions: []*Function{f},
+			exp:       []string{"f expects 1 argument, got 2 at 3 (OP_CALL_FUNC 0)"},
+		},
+		{
+			name: "pop from empty stack",
+			code: []Operation{{OP_PUSH, 0}, {OP_POP, 1}, {OP_POP, 1}},
+			exp:  []string{"pop from empty stack at 2 (OP_POP 1)"},
+		},
+		{
+			name: "return outside of function",
+			code: []Operation{{OP_RETURN, 0}},
+			exp:  []string{"return outside of a function at 0 (OP_RETURN 0)"},
+		},
+		{
+			name:      "result inside function",
+			code:      []Operation{},
+			functions: []*Function{{Name: "g", Code: []Operation{{OP_RESULT, 0}, {OP_RETURN, 0}}}},
+			exp:       []string{"result inside a function at 0 (OP_RESULT 0) in function g"},
+		},
+		{
+			name: "unbalanced function",
+			code: []Operation{},
+			functions: []*Function{
+				{Name: "g", Code: []Operation{{OP_PUSH, 0}, {OP_RETURN, 0}, {OP_NEG, 0}}},
+				{Name: "h", Code: []Operation{{OP_POP, 1}, {OP_RETURN, 0}}},
+			},
+			exp: []string{
+				"function returns with 1 value left on the stack at 1 (OP_RETURN 0) in function g",
+				"unreachable operation after OP_RETURN at 2 (OP_NEG 0) in function g",
+				"missing OP_RETURN at the end at function g",
+				"pop from empty stack at 0 (OP_POP 1) in function h",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Program{Code: test.code, Globals: []string{"x"}, Functions: test.functions}
+			err := Verify(p)
+			var list ErrorList
+			if !errors.As(err, &list) {
+				t.Fatalf("expected ErrorList, got %v", err)
+			}
+			msgs := make([]string, len(list))
+			for i, e := range list {
+				var verifyErr *VerifyError
+				assert.True(t, errors.As(e, &verifyErr))
+				msgs[i] = verifyErr.Diagnostic().Msg
+			}
+			assert.Equal(t, test.exp, msgs)
+		})
+	}
+}
+
+func TestVerifySpans(t *testing.T) {
+	p, err := Assemble(".var x\nOP_LOAD 1\nOP_STORE 16")
+	assert.NoError(t, err)
+	var verifyErr *VerifyError
+	assert.True(t, errors.As(Verify(p), &verifyErr))
+	assert.Equal(t, Position{Offset: 17, Line: 3, Col: 1}, verifyErr.Span.Start)
+}
@@ -1,35 +1,158 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"math"
 )
 
 // represents an operation the virtual machine performs
 type OpCode uint8
 
 const (
-	OP_NOP      OpCode = iota
-	OP_LOAD            // loads the argument into register0
-	OP_STORE           // stores the value of register0 in the specified register, set register0 to 0
-	OP_ADD             // adds the value of register0 and the value of the specified register together, stores the result in register0
-	OP_SUBTRACT        // subtracts the value of register0 from the value of the specified register, stores the result in register0
-	OP_MULTIPY         // multiplies the value of register0 with the value of the specified register, stores the result in register0
-	OP_DIVIDE          // divides the value of register0 by the value of the specified register, stores the result in register0
-	OP_NEG             // negates the value of register0, stores result in register0
-	OP_INSPECT         // prints the value of the given register
+	OP_NOP            OpCode = iota
+	OP_LOAD                  // loads the argument into register0
+	OP_STORE                 // stores the value of register0 in the specified register, set register0 to 0
+	OP_ADD                   // adds the value of register0 and the value of the specified register together, stores the result in register0
+	OP_SUBTRACT              // subtracts the value of register0 from the value of the specified register, stores the result in register0
+	OP_MULTIPY               // multiplies the value of register0 with the value of the specified register, stores the result in register0
+	OP_DIVIDE                // divides the value of the specified register by the value of register0, stores the result in register0
+	OP_FLOOR_DIVIDE          // divides the value of the specified register by the value of register0, rounds the result towards negative infinity, stores it in register0
+	OP_MODULO                // computes the remainder of the floor division of the value of the specified register by the value of register0, stores it in register0
+	OP_POW                   // raises the value of the specified register to the power of the value of register0, stores the result in register0
+	OP_NEG                   // negates the value of register0, stores result in register0
+	OP_INSPECT               // prints the value of the given register
+	OP_LOAD_GLOBAL           // loads the value of the variable in the specified slot into register0
+	OP_STORE_GLOBAL          // stores the value of register0 in the variable in the specified slot, keeps register0
+	OP_PUSH                  // pushes the value of register0 onto the stack
+	OP_POP                   // pops the top of the stack into the specified register
+	OP_CALL                  // calls the specified builtin with the amount of arguments in register0 popped from the stack, stores the result in register0
+	OP_CALL_FUNC             // calls the specified user defined function with the amount of arguments in register0 popped from the stack, stores the result in register0
+	OP_LOAD_LOCAL            // loads the value of the specified parameter of the current function into register0
+	OP_RETURN                // returns from the current function, keeps register0
+	OP_RSUBTRACT             // subtracts the value of the specified register from the value of register0, stores the result in register0
+	OP_RDIVIDE               // divides the value of register0 by the value of the specified register, stores the result in register0
+	OP_RFLOOR_DIVIDE         // divides the value of register0 by the value of the specified register, rounds the result towards negative infinity, stores it in register0
+	OP_RMODULO               // computes the remainder of the floor division of the value of register0 by the value of the specified register, stores it in register0
+	OP_RPOW                  // raises the value of register0 to the power of the value of the specified register, stores the result in register0
+	OP_ADDI                  // like OP_ADD, with the argument in place of the value of the register
+	OP_SUBTRACTI             // like OP_SUBTRACT, with the argument in place of the value of the register
+	OP_MULTIPYI              // like OP_MULTIPY, with the argument in place of the value of the register
+	OP_DIVIDEI               // like OP_DIVIDE, with the argument in place of the value of the register
+	OP_FLOOR_DIVIDEI         // like OP_FLOOR_DIVIDE, with the argument in place of the value of the register
+	OP_MODULOI               // like OP_MODULO, with the argument in place of the value of the register
+	OP_POWI                  // like OP_POW, with the argument in place of the value of the register
+	OP_RSUBTRACTI            // like OP_RSUBTRACT, with the argument in place of the value of the register
+	OP_RDIVIDEI              // like OP_RDIVIDE, with the argument in place of the value of the register
+	OP_RFLOOR_DIVIDEI        // like OP_RFLOOR_DIVIDE, with the argument in place of the value of the register
+	OP_RMODULOI              // like OP_RMODULO, with the argument in place of the value of the register
+	OP_RPOWI                 // like OP_RPOW, with the argument in place of the value of the register
+	OP_RESULT                // appends the value of register0 to the results of the program
 )
 
 var OP_LOOKUP = map[OpCode]string{
-	OP_NOP:      "OP_NOP",
-	OP_LOAD:     "OP_LOAD",
-	OP_STORE:    "OP_STORE",
-	OP_ADD:      "OP_ADD",
-	OP_SUBTRACT: "OP_SUBTRACT",
-	OP_MULTIPY:  "OP_MULTIPY",
-	OP_DIVIDE:   "OP_DIVIDE",
-	OP_NEG:      "OP_NEG",
-	OP_INSPECT:  "OP_INSPECT",
+	OP_NOP:            "OP_NOP",
+	OP_LOAD:           "OP_LOAD",
+	OP_STORE:          "OP_STORE",
+	OP_ADD:            "OP_ADD",
+	OP_SUBTRACT:       "OP_SUBTRACT",
+	OP_MULTIPY:        "OP_MULTIPY",
+	OP_DIVIDE:         "OP_DIVIDE",
+	OP_FLOOR_DIVIDE:   "OP_FLOOR_DIVIDE",
+	OP_MODULO:         "OP_MODULO",
+	OP_POW:            "OP_POW",
+	OP_NEG:            "OP_NEG",
+	OP_INSPECT:        "OP_INSPECT",
+	OP_LOAD_GLOBAL:    "OP_LOAD_GLOBAL",
+	OP_STORE_GLOBAL:   "OP_STORE_GLOBAL",
+	OP_PUSH:           "OP_PUSH",
+	OP_POP:            "OP_POP",
+	OP_CALL:           "OP_CALL",
+	OP_CALL_FUNC:      "OP_CALL_FUNC",
+	OP_LOAD_LOCAL:     "OP_LOAD_LOCAL",
+	OP_RETURN:         "OP_RETURN",
+	OP_RSUBTRACT:      "OP_RSUBTRACT",
+	OP_RDIVIDE:        "OP_RDIVIDE",
+	OP_RFLOOR_DIVIDE:  "OP_RFLOOR_DIVIDE",
+	OP_RMODULO:        "OP_RMODULO",
+	OP_RPOW:           "OP_RPOW",
+	OP_ADDI:           "OP_ADDI",
+	OP_SUBTRACTI:      "OP_SUBTRACTI",
+	OP_MULTIPYI:       "OP_MULTIPYI",
+	OP_DIVIDEI:        "OP_DIVIDEI",
+	OP_FLOOR_DIVIDEI:  "OP_FLOOR_DIVIDEI",
+	OP_MODULOI:        "OP_MODULOI",
+	OP_POWI:           "OP_POWI",
+	OP_RSUBTRACTI:     "OP_RSUBTRACTI",
+	OP_RDIVIDEI:       "OP_RDIVIDEI",
+	OP_RFLOOR_DIVIDEI: "OP_RFLOOR_DIVIDEI",
+	OP_RMODULOI:       "OP_RMODULOI",
+	OP_RPOWI:          "OP_RPOWI",
+	OP_RESULT:         "OP_RESULT",
+}
+
+// describes an arithmetic operation by the operation it is based on, if it
+// swaps the operands of the base operation and if its argument is a value
+// instead of a register
+type arithmetic struct {
+	base      OpCode
+	reversed  bool
+	immediate bool
+}
+
+// all arithmetic operations, base operations compute 'register OP register0'
+var ARITHMETIC = map[OpCode]arithmetic{
+	OP_ADD:            {base: OP_ADD},
+	OP_SUBTRACT:       {base: OP_SUBTRACT},
+	OP_MULTIPY:        {base: OP_MULTIPY},
+	OP_DIVIDE:         {base: OP_DIVIDE},
+	OP_FLOOR_DIVIDE:   {base: OP_FLOOR_DIVIDE},
+	OP_MODULO:         {base: OP_MODULO},
+	OP_POW:            {base: OP_POW},
+	OP_RSUBTRACT:      {base: OP_SUBTRACT, reversed: true},
+	OP_RDIVIDE:        {base: OP_DIVIDE, reversed: true},
+	OP_RFLOOR_DIVIDE:  {base: OP_FLOOR_DIVIDE, reversed: true},
+	OP_RMODULO:        {base: OP_MODULO, reversed: true},
+	OP_RPOW:           {base: OP_POW, reversed: true},
+	OP_ADDI:           {base: OP_ADD, immediate: true},
+	OP_SUBTRACTI:      {base: OP_SUBTRACT, immediate: true},
+	OP_MULTIPYI:       {base: OP_MULTIPY, immediate: true},
+	OP_DIVIDEI:        {base: OP_DIVIDE, immediate: true},
+	OP_FLOOR_DIVIDEI:  {base: OP_FLOOR_DIVIDE, immediate: true},
+	OP_MODULOI:        {base: OP_MODULO, immediate: true},
+	OP_POWI:           {base: OP_POW, immediate: true},
+	OP_RSUBTRACTI:     {base: OP_SUBTRACT, reversed: true, immediate: true},
+	OP_RDIVIDEI:       {base: OP_DIVIDE, reversed: true, immediate: true},
+	OP_RFLOOR_DIVIDEI: {base: OP_FLOOR_DIVIDE, reversed: true, immediate: true},
+	OP_RMODULOI:       {base: OP_MODULO, reversed: true, immediate: true},
+	OP_RPOWI:          {base: OP_POW, reversed: true, immediate: true},
+}
+
+// computes the arithmetic operation code, operand is the value of the
+// register or the argument for immediate operations
+func compute(code OpCode, operand, reg0 float64) float64 {
+	op := ARITHMETIC[code]
+	left, right := operand, reg0
+	if op.reversed {
+		left, right = reg0, operand
+	}
+	switch op.base {
+	case OP_ADD:
+		return left + right
+	case OP_SUBTRACT:
+		return left - right
+	case OP_MULTIPY:
+		return left * right
+	case OP_DIVIDE:
+		return left / right
+	case OP_FLOOR_DIVIDE:
+		return floorDiv(left, right)
+	case OP_MODULO:
+		return floorMod(left, right)
+	case OP_POW:
+		return math.Pow(left, right)
+	}
+	return math.NaN()
 }
 
 // represents an operation and its argument
@@ -41,6 +164,10 @@ type Operation struct {
 // max amount of registers in virtual machine
 const REGISTER_COUNT int = 16
 
+// register the compiler pops spilled values into, not handed out by the
+// RegisterAllocator
+const SPILL_REGISTER int = REGISTER_COUNT - 1
+
 // The virtual machine (VM) is a way to simulate the inner workings of a processor.
 //
 // Programming using the byte code accepted by this virtual machine is a very
@@ -62,28 +189,139 @@ const REGISTER_COUNT int = 16
 //   - OP_ADD      <register>      ; adds the value of register 0 to the value at 'register', stores result in register 0
 //   - OP_SUBTRACT <register>      ; subtracts the value of register 0 from the value at 'register', stores result in register 0
 //   - OP_MULTIPY  <register>      ; multiplies the value of register 0 with the value at 'register', stores result in register 0
-//   - OP_DIVIDE   <register>      ; divides the value of register 0 with the value at 'register', stores result in register 0
+//   - OP_DIVIDE   <register>      ; divides the value at 'register' by the value of register 0, stores result in register 0
+//   - OP_FLOOR_DIVIDE <register>  ; divides the value at 'register' by the value of register 0, rounds towards negative infinity, stores result in register 0
+//   - OP_MODULO   <register>      ; computes the value at 'register' modulo the value of register 0, stores result in register 0
+//   - OP_POW      <register>      ; raises the value at 'register' to the power of the value of register 0, stores result in register 0
 //   - OP_NEG                      ; negates the value of register 0
 //   - OP_INSPECT  <register>      ; prints the value of 'register'
+//   - OP_LOAD_GLOBAL  <slot>      ; loads the value of the variable in 'slot' into register 0
+//   - OP_STORE_GLOBAL <slot>      ; stores the value of register 0 in the variable in 'slot'
+//   - OP_PUSH                     ; pushes the value of register 0 onto the stack
+//   - OP_POP      <register>      ; pops the top of the stack into 'register'
+//   - OP_CALL     <builtin>       ; calls 'builtin' (index into BUILTINS) with as many arguments popped from the stack as register 0 specifies, stores result in register 0
+//   - OP_CALL_FUNC <function>     ; calls the user defined 'function' (slot in the environment) like OP_CALL
+//   - OP_LOAD_LOCAL <param>       ; loads the value of the parameter at index 'param' of the current function into register 0
+//   - OP_RETURN                   ; returns from the current function to the caller, keeps register 0
+//   - OP_RSUBTRACT <register>     ; subtracts the value at 'register' from the value of register 0, stores result in register 0
+//   - OP_RDIVIDE  <register>      ; divides the value of register 0 by the value at 'register', stores result in register 0
+//   - OP_RFLOOR_DIVIDE <register> ; divides the value of register 0 by the value at 'register', rounds towards negative infinity, stores result in register 0
+//   - OP_RMODULO  <register>      ; computes the value of register 0 modulo the value at 'register', stores result in register 0
+//   - OP_RPOW     <register>      ; raises the value of register 0 to the power of the value at 'register', stores result in register 0
+//   - OP_ADDI     <value>         ; adds the value of register 0 to 'value', stores result in register 0
+//   - OP_SUBTRACTI <value>        ; subtracts the value of register 0 from 'value', stores result in register 0
+//   - OP_MULTIPYI <value>         ; multiplies the value of register 0 with 'value', stores result in register 0
+//   - OP_DIVIDEI  <value>         ; divides 'value' by the value of register 0, stores result in register 0
+//   - OP_FLOOR_DIVIDEI <value>    ; divides 'value' by the value of register 0, rounds towards negative infinity, stores result in register 0
+//   - OP_MODULOI  <value>         ; computes 'value' modulo the value of register 0, stores result in register 0
+//   - OP_POWI     <value>         ; raises 'value' to the power of the value of register 0, stores result in register 0
+//   - OP_RSUBTRACTI <value>       ; subtracts 'value' from the value of register 0, stores result in register 0
+//   - OP_RDIVIDEI <value>         ; divides the value of register 0 by 'value', stores result in register 0
+//   - OP_RFLOOR_DIVIDEI <value>   ; divides the value of register 0 by 'value', rounds towards negative infinity, stores result in register 0
+//   - OP_RMODULOI <value>         ; computes the value of register 0 modulo 'value', stores result in register 0
+//   - OP_RPOWI    <value>         ; raises the value of register 0 to the power of 'value', stores result in register 0
+//   - OP_RESULT                   ; appends the value of register 0 to the results
+//
+// The reversed operations (OP_R*) swap the operands of their counterparts,
+// the compiler emits them if it computes the right operand of a non
+// commutative operation first. The immediate operations (OP_*I) take the
+// operand from their argument instead of a register, the peephole optimizer
+// (Peephole) replaces loading a number and combining it with a register by
+// them.
+//
+// OP_FLOOR_DIVIDE and OP_MODULO satisfy a == (a // b) * b + a % b, the result
+// of OP_MODULO therefore has the sign of the divisor: -7 % 3 == 2 and
+// 7 % -3 == -2. Like OP_DIVIDE they follow IEEE 754 for a divisor of zero:
+// a // 0 is +Inf or -Inf depending on the sign of a (NaN for 0 // 0) and a % 0
+// is NaN.
+//
+// The compiler emits OP_RESULT after every top level expression except
+// function definitions, Results returns the values in the order they were
+// emitted and Emit receives each of them as soon as it is emitted.
+//
+// Variables live in the environment (Env) of the VM, not in registers. The
+// compiler assigns each variable a slot in the environment, the environment
+// is kept between calls to Execute.
+//
+// Calling a builtin function requires pushing its arguments onto the stack in
+// order, loading the amount of arguments into register 0 and executing
+// OP_CALL with the index of the builtin, for instance max(1, 2):
+//
+//	OP_LOAD 1
+//	OP_PUSH
+//	OP_LOAD 2
+//	OP_PUSH
+//	OP_LOAD 2
+//	OP_CALL 23
+//
+// User defined functions are compiled to separate chunks of operations ending
+// with OP_RETURN, stored in the environment. OP_CALL_FUNC pushes a call frame
+// saving the registers and the position of the caller and continues with the
+// first operation of the function, its arguments are accessible via
+// OP_LOAD_LOCAL. OP_RETURN pops the frame, restores the registers of the
+// caller except register 0, which holds the result, and continues after the
+// OP_CALL_FUNC. Calls can nest up to MAX_CALL_DEPTH frames, or up to
+// MaxCallDepth frames if set.
+//
+// If the compiler runs out of registers, it spills values to the stack using
+// OP_PUSH and pops them into SPILL_REGISTER right before the operation that
+// consumes them, therefore the depth of expressions is only limited by the
+// size of the stack:
+//
+//	OP_PUSH                        ; left value to the stack
+//	...                            ; compute right value into register 0
+//	OP_POP      15                 ; left value into SPILL_REGISTER
+//	OP_ADD      15
 //
 // All results operations such as OP_ADD generate are stored in register 0. The
 // amount of available registers is defined in REGISTER_COUNT and by default
-// set to 4. The VM expects the last instruction to contain the Operation code
-// (OP_CODE) OP_END, otherwise it will be stuck in an endless loop.
+// set to 4. Execute checks operations only as far as needed to not crash,
+// bytecode loaded from files is checked with Verify before executing it.
+//
+// Untrusted input is executed with budgets: MaxInstructions limits the amount
+// of executed operations, MaxCallDepth the nesting of calls, exceeding either
+// fails with a *BudgetError. ExecuteContext additionally stops once its
+// context is canceled, for instance by a deadline.
 type Vm struct {
-	reg   [REGISTER_COUNT]float64 // registers
-	in    []Operation             // operations to execute
-	pos   int                     // current position in input
-	trace bool                    // prints every operation if enabled
-	atEnd bool                    // indicates if the vm reached the end of the input
+	reg     [REGISTER_COUNT]float64 // registers
+	in      []Operation             // operations to execute
+	pos     int                     // current position in input
+	atEnd   bool                    // indicates if the vm reached the end of the input
+	env     *Env                    // variables, kept between executions
+	stack   []float64               // arguments for calls
+	frames  []frame                 // call frames of user defined functions
+	results []float64               // values emitted by OP_RESULT
+
+	Trace           Tracer              // receives every executed operation, nil disables tracing
+	Emit            func(value float64) // receives every result, called in addition to collecting it
+	MaxInstructions int                 // operations executed per input before failing with a *BudgetError, 0 for no limit
+	MaxCallDepth    int                 // nested calls before failing with a *BudgetError, 0 for MAX_CALL_DEPTH and a *StackOverflowError, both match ErrBudgetExceeded
+	executed        int                 // operations executed since the input was assigned
+}
+
+// state of the caller of a user defined function and the arguments of the
+// callee
+type frame struct {
+	fn     *Function
+	in     []Operation             // operations of the caller
+	pos    int                     // position of the OP_CALL_FUNC in the caller
+	reg    [REGISTER_COUNT]float64 // registers of the caller
+	locals []float64               // arguments of the callee
 }
 
-// assigns new input to the vm, resets its state
+// assigns new input to the vm, resets its state except the environment
 func (vm *Vm) NewVmIn(in []Operation) *Vm {
+	if vm.env == nil {
+		vm.env = NewEnv()
+	}
 	vm.pos = 0
 	vm.in = in
 	vm.reg = [REGISTER_COUNT]float64{}
+	vm.stack = vm.stack[:0]
+	vm.frames = vm.frames[:0]
 	vm.atEnd = false
+	vm.executed = 0
+	vm.results = nil
 	return vm
 }
 
@@ -101,53 +339,270 @@ func (vm *Vm) cur() Operation {
 	return vm.in[vm.pos]
 }
 
-// checks if index is in register boundary, converts to int, returns
-func regBoundCheck(index float64) int {
-	i := int(index)
-	if i < 0 || i > REGISTER_COUNT {
-		log.Panicf("vm: Out of bounds register access for %d", i)
-	}
-	return i
-}
-
-func (vm *Vm) Execute() {
-	if len(vm.in) == 0 {
-		return
-	}
-	for !vm.atEnd {
-		cur := vm.cur()
-		if vm.trace {
-			fmt.Printf("%-15s %.2f\n", OP_LOOKUP[cur.Code], cur.Arg)
-		}
-
-		switch cur.Code {
-		case OP_NOP:
-		case OP_LOAD:
-			vm.reg[0] = cur.Arg
-		case OP_NEG:
-			vm.reg[0] = -vm.reg[0]
-		case OP_STORE:
-			i := regBoundCheck(cur.Arg)
-			vm.reg[i] = vm.reg[0]
-			vm.reg[0] = 0
-		case OP_INSPECT:
-			i := regBoundCheck(cur.Arg)
-			fmt.Printf("vm: %7s reg[%d] => %f\n", "INSPECT", i, vm.reg[i])
-		case OP_ADD:
-			i := regBoundCheck(cur.Arg)
-			vm.reg[0] = vm.reg[i] + vm.reg[0]
-		case OP_SUBTRACT:
-			i := regBoundCheck(cur.Arg)
-			vm.reg[0] = vm.reg[i] - vm.reg[0]
-		case OP_MULTIPY:
-			i := regBoundCheck(cur.Arg)
-			vm.reg[0] = vm.reg[i] * vm.reg[0]
-		case OP_DIVIDE:
-			i := regBoundCheck(cur.Arg)
-			vm.reg[0] = vm.reg[i] / vm.reg[0]
-		default:
-			log.Panicf("Unkown operator %v", OP_LOOKUP[cur.Code])
-		}
-		vm.advance()
+// divides a by b, rounds towards negative infinity. Derived from the
+// remainder instead of math.Floor(a/b), since a/b can round up to the next
+// integer (1 // 0.1 would be 10 instead of 9)
+func floorDiv(a, b float64) float64 {
+	if b == 0 || math.IsInf(b, 0) {
+		return math.Floor(a / b)
+	}
+	mod := math.Mod(a, b)
+	div := (a - mod) / b
+	if mod != 0 && (mod < 0) != (b < 0) {
+		div -= 1
+	}
+	// (a - mod) / b is an integer up to rounding errors
+	floor := math.Floor(div)
+	if div-floor > 0.5 {
+		floor += 1
+	}
+	return floor
+}
+
+// remainder of floorDiv, has the sign of b
+func floorMod(a, b float64) float64 {
+	r := math.Mod(a, b)
+	if r != 0 && (r < 0) != (b < 0) {
+		r += b
+	}
+	return r
+}
+
+// checks if the argument of the current operation is in register boundary,
+// converts to int, returns
+func (vm *Vm) regBoundCheck() (int, error) {
+	arg := vm.cur().Arg
+	i := int(arg)
+	if float64(i) != arg {
+		return 0, vm.error(fmt.Sprintf("register %v is not an integer", arg))
+	}
+	if i < 0 || i >= REGISTER_COUNT {
+		return 0, vm.error(fmt.Sprintf("out of bounds register access for %d", i))
+	}
+	return i, nil
+}
+
+// creates a *RuntimeError for the current operation
+func (vm *Vm) error(msg string) error {
+	err := &RuntimeError{Pos: vm.pos, Msg: msg}
+	if vm.pos >= 0 && vm.pos < len(vm.in) {
+		err.Op = vm.cur()
+	}
+	return err
+}
+
+// operations ExecuteContext executes between checks of its context
+const CANCEL_CHECK_INTERVAL int = 1024
+
+// executes the input of the vm, returns a *RuntimeError if an operation
+// could not be executed and a *BudgetError if a budget was exceeded
+func (vm *Vm) Execute() error {
+	return vm.ExecuteContext(context.Background())
+}
+
+// like Execute, stops with the error of ctx once ctx is canceled or its
+// deadline passed. ctx is checked every CANCEL_CHECK_INTERVAL operations
+func (vm *Vm) ExecuteContext(ctx context.Context) error {
+	for i := 0; !vm.Done(); i++ {
+		if i%CANCEL_CHECK_INTERVAL == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if err := vm.Step(); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// values emitted by OP_RESULT since the input was assigned
+func (vm *Vm) Results() []float64 {
+	return vm.results
+}
+
+// reports if the vm executed all of its input
+func (vm *Vm) Done() bool {
+	return vm.atEnd || len(vm.in) == 0
+}
+
+// name of the function the current operation belongs to, empty for the main
+// code, and the position of the operation in it
+func (vm *Vm) location() (string, int) {
+	if len(vm.frames) == 0 {
+		return "", vm.pos
+	}
+	return vm.frames[len(vm.frames)-1].fn.Name, vm.pos
+}
+
+// executes the current operation and advances to the next one, does nothing
+// if the vm is done. Returns a *RuntimeError if the operation could not be
+// executed
+func (vm *Vm) Step() error {
+	if vm.Done() {
+		return nil
+	}
+	if vm.MaxInstructions > 0 && vm.executed >= vm.MaxInstructions {
+		return &BudgetError{Budget: BUDGET_INSTRUCTIONS, Limit: vm.MaxInstructions, Pos: vm.pos, Op: vm.cur()}
+	}
+	vm.executed++
+
+	cur := vm.cur()
+	var record TraceRecord
+	if vm.Trace != nil {
+		record = TraceRecord{Depth: len(vm.frames), Op: cur, Before: vm.reg}
+		record.Function, record.Pc = vm.location()
+	}
+
+	switch cur.Code {
+	case OP_NOP:
+	case OP_LOAD:
+		vm.reg[0] = cur.Arg
+	case OP_NEG:
+		vm.reg[0] = -vm.reg[0]
+	case OP_STORE:
+		i, err := vm.regBoundCheck()
+		if err != nil {
+			return err
+		}
+		vm.reg[i] = vm.reg[0]
+		vm.reg[0] = 0
+	case OP_LOAD_GLOBAL:
+		val, ok := vm.env.load(int(cur.Arg))
+		if !ok {
+			return vm.error(fmt.Sprintf("variable %q used before assignment", vm.env.name(int(cur.Arg))))
+		}
+		vm.reg[0] = val
+	case OP_STORE_GLOBAL:
+		if !vm.env.store(int(cur.Arg), vm.reg[0]) {
+			return vm.error("out of bounds variable access")
+		}
+	case OP_PUSH:
+		vm.stack = append(vm.stack, vm.reg[0])
+	case OP_POP:
+		i, err := vm.regBoundCheck()
+		if err != nil {
+			return err
+		}
+		if len(vm.stack) == 0 {
+			return vm.error("pop from empty stack")
+		}
+		vm.reg[i] = vm.stack[len(vm.stack)-1]
+		vm.stack = vm.stack[:len(vm.stack)-1]
+	case OP_CALL:
+		i := int(cur.Arg)
+		if i < 0 || i >= len(BUILTINS) {
+			return vm.error("unknown builtin")
+		}
+		argc := int(vm.reg[0])
+		if argc < 0 || argc > len(vm.stack) {
+			return vm.error(fmt.Sprintf("not enough arguments on the stack for %s", BUILTINS[i].Name))
+		}
+		if err := BUILTINS[i].checkArity(argc); err != nil {
+			return vm.error(err.Error())
+		}
+		args := vm.stack[len(vm.stack)-argc:]
+		vm.reg[0] = BUILTINS[i].Fn(args)
+		vm.stack = vm.stack[:len(vm.stack)-argc]
+	case OP_CALL_FUNC:
+		if err := vm.call(); err != nil {
+			return err
+		}
+		// the first operation of the function is at 0, advance
+		// increments pos after the switch
+		vm.pos = -1
+	case OP_LOAD_LOCAL:
+		if len(vm.frames) == 0 {
+			return vm.error("parameter access outside of a function")
+		}
+		locals := vm.frames[len(vm.frames)-1].locals
+		i := int(cur.Arg)
+		if i < 0 || i >= len(locals) {
+			return vm.error("out of bounds parameter access")
+		}
+		vm.reg[0] = locals[i]
+	case OP_RETURN:
+		if len(vm.frames) == 0 {
+			return vm.error("return outside of a function")
+		}
+		f := vm.frames[len(vm.frames)-1]
+		vm.frames = vm.frames[:len(vm.frames)-1]
+		result := vm.reg[0]
+		vm.in, vm.pos, vm.reg = f.in, f.pos, f.reg
+		vm.reg[0] = result
+	case OP_INSPECT:
+		i, err := vm.regBoundCheck()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("vm: %7s reg[%d] => %f\n", "INSPECT", i, vm.reg[i])
+	case OP_ADD, OP_SUBTRACT, OP_MULTIPY, OP_DIVIDE, OP_FLOOR_DIVIDE, OP_MODULO, OP_POW,
+		OP_RSUBTRACT, OP_RDIVIDE, OP_RFLOOR_DIVIDE, OP_RMODULO, OP_RPOW:
+		i, err := vm.regBoundCheck()
+		if err != nil {
+			return err
+		}
+		vm.reg[0] = compute(cur.Code, vm.reg[i], vm.reg[0])
+	case OP_ADDI, OP_SUBTRACTI, OP_MULTIPYI, OP_DIVIDEI, OP_FLOOR_DIVIDEI, OP_MODULOI, OP_POWI,
+		OP_RSUBTRACTI, OP_RDIVIDEI, OP_RFLOOR_DIVIDEI, OP_RMODULOI, OP_RPOWI:
+		vm.reg[0] = compute(cur.Code, cur.Arg, vm.reg[0])
+	case OP_RESULT:
+		vm.results = append(vm.results, vm.reg[0])
+		if vm.Emit != nil {
+			vm.Emit(vm.reg[0])
+		}
+	default:
+		return vm.error("unknown operator")
+	}
+	if vm.Trace != nil {
+		record.After = vm.reg
+		vm.Trace(record)
+	}
+	vm.advance()
+	if vm.atEnd && len(vm.frames) > 0 {
+		return vm.error(fmt.Sprintf("function %s did not return", vm.frames[len(vm.frames)-1].fn.Name))
+	}
+	return nil
+}
+
+// pushes a frame for the function called by the current operation, pops its
+// arguments from the stack and switches to the operations of the function
+func (vm *Vm) call() error {
+	fn := vm.env.function(int(vm.cur().Arg))
+	if fn == nil {
+		if name := vm.env.funcName(int(vm.cur().Arg)); name != "" {
+			return vm.error(fmt.Sprintf("unknown function %q", name))
+		}
+		return vm.error("unknown function")
+	}
+	if len(fn.Code) == 0 {
+		return vm.error(fmt.Sprintf("function %s is not compiled", fn.Name))
+	}
+	if vm.MaxCallDepth > 0 {
+		if len(vm.frames) >= vm.MaxCallDepth {
+			return &BudgetError{Budget: BUDGET_CALL_DEPTH, Limit: vm.MaxCallDepth, Pos: vm.pos, Op: vm.cur()}
+		}
+	} else if len(vm.frames) >= MAX_CALL_DEPTH {
+		return &StackOverflowError{Function: fn.Name, Depth: MAX_CALL_DEPTH}
+	}
+	argc := int(vm.reg[0])
+	if argc < 0 || argc > len(vm.stack) {
+		return vm.error(fmt.Sprintf("not enough arguments on the stack for %s", fn.Name))
+	}
+	if err := fn.checkArity(argc); err != nil {
+		return vm.error(err.Error())
+	}
+	locals := make([]float64, argc)
+	copy(locals, vm.stack[len(vm.stack)-argc:])
+	vm.stack = vm.stack[:len(vm.stack)-argc]
+	vm.frames = append(vm.frames, frame{
+		fn:     fn,
+		in:     vm.in,
+		pos:    vm.pos,
+		reg:    vm.reg,
+		locals: locals,
+	})
+	vm.in = fn.Code
+	vm.reg = [REGISTER_COUNT]float64{}
+	return nil
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestVm(t *testing.T) {
@@ -66,6 +72,121 @@ func TestVm(t *testing.T) {
 			},
 			exp: 12.5,
 		},
+		{
+			name: "power",
+			ops: []Operation{
+				{OP_LOAD, 2},
+				{OP_STORE, 1},
+				{OP_LOAD, 10},
+				{OP_POW, 1},
+			},
+			exp: 1024,
+		},
+		{
+			name: "reversed subtraction",
+			ops: []Operation{
+				{OP_LOAD, 5},
+				{OP_STORE, 1},
+				{OP_LOAD, 9},
+				{OP_RSUBTRACT, 1},
+			},
+			exp: 4,
+		},
+		{
+			name: "reversed division",
+			ops: []Operation{
+				{OP_LOAD, 2},
+				{OP_STORE, 1},
+				{OP_LOAD, 25},
+				{OP_RDIVIDE, 1},
+			},
+			exp: 12.5,
+		},
+		{
+			name: "reversed floor division",
+			ops: []Operation{
+				{OP_LOAD, 2},
+				{OP_STORE, 1},
+				{OP_LOAD, -7},
+				{OP_RFLOOR_DIVIDE, 1},
+			},
+			exp: -4,
+		},
+		{
+			name: "reversed modulo",
+			ops: []Operation{
+				{OP_LOAD, 3},
+				{OP_STORE, 1},
+				{OP_LOAD, -7},
+				{OP_RMODULO, 1},
+			},
+			exp: 2,
+		},
+		{
+			name: "reversed power",
+			ops: []Operation{
+				{OP_LOAD, 10},
+				{OP_STORE, 1},
+				{OP_LOAD, 2},
+				{OP_RPOW, 1},
+			},
+			exp: 1024,
+		},
+		{
+			name: "floor division",
+			ops: []Operation{
+				{OP_LOAD, -7},
+				{OP_STORE, 1},
+				{OP_LOAD, 2},
+				{OP_FLOOR_DIVIDE, 1},
+			},
+			exp: -4,
+		},
+		{
+			name: "modulo",
+			ops: []Operation{
+				{OP_LOAD, -7},
+				{OP_STORE, 1},
+				{OP_LOAD, 3},
+				{OP_MODULO, 1},
+			},
+			exp: 2,
+		},
+		{
+			name: "globals",
+			ops: []Operation{
+				{OP_LOAD, 21},
+				{OP_STORE_GLOBAL, 0},
+				{OP_LOAD, 2},
+				{OP_STORE, 1},
+				{OP_LOAD_GLOBAL, 0},
+				{OP_MULTIPY, 1},
+			},
+			exp: 42,
+		},
+		{
+			name: "call",
+			ops: []Operation{
+				{OP_LOAD, 3},
+				{OP_PUSH, 0},
+				{OP_LOAD, 4},
+				{OP_PUSH, 0},
+				{OP_LOAD, 2},
+				{OP_CALL, float64(builtinIndex["hypot"])},
+			},
+			exp: 5,
+		},
+		{
+			name: "spill",
+			ops: []Operation{
+				{OP_LOAD, 10},
+				{OP_PUSH, 0},
+				{OP_LOAD, 4},
+				{OP_POP, float64(SPILL_REGISTER)},
+				{OP_SUBTRACT, float64(SPILL_REGISTER)},
+			},
+			exp: 6,
+		},
 		{
 			name: "2+1*1",
 			ops: []Operation{
@@ -81,11 +202,15 @@ func TestVm(t *testing.T) {
 		},
 	}
 
-	v := Vm{trace: false}
+	v := Vm{}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
+			v.env = NewEnv()
+			v.env.declare("x")
 			v.NewVmIn(test.ops)
-			v.Execute()
+			if err := v.Execute(); err != nil {
+				t.Fatalf("execution failed: %s", err)
+			}
 			if v.reg[0] != test.exp {
 				in := make([]string, len(test.ops))
 				for i, o := range test.ops {
@@ -96,3 +221,155 @@ func TestVm(t *testing.T) {
 		})
 	}
 }
+
+func TestVmErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []Operation
+	}{
+		{
+			name: "unknown operator",
+			ops:  []Operation{{OpCode(255), 0}},
+		},
+		{
+			name: "unassigned variable",
+			ops:  []Operation{{OP_LOAD_GLOBAL, 0}},
+		},
+		{
+			name: "out of bounds variable",
+			ops:  []Operation{{OP_STORE_GLOBAL, 3}},
+		},
+		{
+			name: "unknown builtin",
+			ops:  []Operation{{OP_LOAD, 0}, {OP_CALL, float64(len(BUILTINS))}},
+		},
+		{
+			name: "missing arguments on stack",
+			ops:  []Operation{{OP_LOAD, 1}, {OP_CALL, float64(builtinIndex["sqrt"])}},
+		},
+		{
+			name: "wrong number of arguments",
+			ops:  []Operation{{OP_PUSH, 0}, {OP_PUSH, 0}, {OP_LOAD, 2}, {OP_CALL, float64(builtinIndex["sqrt"])}},
+		},
+		{
+			name: "pop from empty stack",
+			ops:  []Operation{{OP_POP, 1}},
+		},
+		{
+			name: "negative register",
+			ops:  []Operation{{OP_STORE, -1}},
+		},
+		{
+			name: "register past the last",
+			ops:  []Operation{{OP_STORE, float64(REGISTER_COUNT)}},
+		},
+		{
+			name: "non integer register",
+			ops:  []Operation{{OP_STORE, 1.5}},
+		},
+	}
+
+	v := Vm{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v.NewVmIn(test.ops)
+			var runtimeErr *RuntimeError
+			if err := v.Execute(); !errors.As(err, &runtimeErr) {
+				t.Errorf("expected *RuntimeError, got %v", err)
+			}
+		})
+	}
+	t.Run("function without operations", func(t *testing.T) {
+		env := NewEnv()
+		env.defineFunc(&Function{Name: "empty", Code: []Operation{}})
+		vm := Vm{env: env}
+		var runtimeErr *RuntimeError
+		if assert.ErrorAs(t, vm.NewVmIn([]Operation{{OP_LOAD, 0}, {OP_CALL_FUNC, 0}}).Execute(), &runtimeErr) {
+			assert.Equal(t, "function empty is not compiled", runtimeErr.Msg)
+		}
+	})
+}
+
+func TestFloorDivMod(t *testing.T) {
+	tests := []struct {
+		a, b     float64
+		div, mod float64
+	}{
+		{7, 3, 2, 1},
+		{-7, 3, -3, 2},
+		{7, -3, -3, -2},
+		{-7, -3, 2, -1},
+		{7.5, 2, 3, 1.5},
+		{1, 0.1, 9, 0.09999999999999995},
+		{5, 0, math.Inf(1), math.NaN()},
+		{-5, 0, math.Inf(-1), math.NaN()},
+		{0, 0, math.NaN(), math.NaN()},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v by %v", test.a, test.b), func(t *testing.T) {
+			div, mod := floorDiv(test.a, test.b), floorMod(test.a, test.b)
+			if !sameFloat(div, test.div) || !sameFloat(mod, test.mod) {
+				t.Errorf("wanted %v // %v = %v and %v %% %v = %v, got %v and %v", test.a, test.b, test.div, test.a, test.b, test.mod, div, mod)
+			}
+		})
+	}
+}
+
+func TestVmBudget(t *testing.T) {
+	code := []Operation{{OP_LOAD, 1}, {OP_STORE, 1}, {OP_LOAD, 2}, {OP_ADD, 1}}
+
+	vm := Vm{MaxInstructions: len(code)}
+	assert.NoError(t, vm.NewVmIn(code).Execute())
+	assert.Equal(t, float64(3), vm.reg[0])
+	// the budget applies per input
+	assert.NoError(t, vm.NewVmIn(code).Execute())
+
+	vm.MaxInstructions = len(code) - 1
+	err := vm.NewVmIn(code).Execute()
+	var budgetErr *BudgetError
+	assert.True(t, errors.As(err, &budgetErr))
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	assert.Equal(t, BudgetError{Budget: BUDGET_INSTRUCTIONS, Limit: 3, Pos: 3, Op: Operation{OP_ADD, 1}}, *budgetErr)
+}
+
+func TestVmCallDepthBudget(t *testing.T) {
+	env := NewEnv()
+	code, err := Compile(env, parse(t, "f(x) = f(x)\nf(1)"))
+	assert.NoError(t, err)
+
+	vm := Vm{env: env, MaxCallDepth: 10}
+	err = vm.NewVmIn(code).Execute()
+	var budgetErr *BudgetError
+	assert.True(t, errors.As(err, &budgetErr))
+	assert.Equal(t, BUDGET_CALL_DEPTH, budgetErr.Budget)
+	assert.Equal(t, 10, len(vm.frames))
+
+	vm.MaxCallDepth = 0
+	var overflow *StackOverflowError
+	assert.True(t, errors.As(vm.NewVmIn(code).Execute(), &overflow))
+	assert.True(t, errors.Is(overflow, ErrBudgetExceeded))
+}
+
+func TestExecuteContext(t *testing.T) {
+	code := make([]Operation, 10*CANCEL_CHECK_INTERVAL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	vm := Vm{}
+	assert.ErrorIs(t, vm.NewVmIn(code).ExecuteContext(ctx), context.Canceled)
+	assert.Equal(t, 0, vm.executed)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	vm.Trace = func(r TraceRecord) {
+		if r.Pc == 10 {
+			cancel()
+		}
+	}
+	assert.ErrorIs(t, vm.NewVmIn(code).ExecuteContext(ctx), context.Canceled)
+	assert.Equal(t, CANCEL_CHECK_INTERVAL, vm.executed)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	vm.Trace = nil
+	assert.NoError(t, vm.NewVmIn(code).ExecuteContext(ctx))
+}